@@ -2,6 +2,7 @@ package datastore
 
 import (
 	"fmt"
+	"reflect"
 
 	"golang.org/x/net/context"
 )
@@ -145,7 +146,9 @@ type Datastore interface {
 	// official datastore package. Entities can be any []S or []*S where S is a
 	// struct. If an entity cannot be found then an error will be returned with
 	// method signature NotFound(index int) bool where index is the key/entity
-	// index that is being being checked for presence.
+	// index that is being being checked for presence. If a property cannot
+	// be loaded into its struct an *ErrFieldMismatch is returned once the
+	// other properties have been loaded.
 	Get(keys []Key, entities interface{}) error
 
 	// Put saves entities to the datastore. Complete or incomplete string or
@@ -177,6 +180,48 @@ type TransactionalDatastore interface {
 	RunInTransaction(f func(ds Datastore) error) error
 }
 
+// KeyRangeAllocator is implemented by datastores that can reserve ranges of
+// integer IDs. It is separate from Datastore so existing implementations do
+// not have to support it. Use the AllocateKeyRange function rather than
+// asserting it directly.
+type KeyRangeAllocator interface {
+
+	// AllocateKeyRange reserves the integer IDs from start to end inclusive
+	// for the kind and parents of key so they are never returned by
+	// AllocateKeys. It is the AllocateIDRange equivalent in the official
+	// datastore package and is useful when importing entities with fixed IDs.
+	// An error is returned if any entities already use IDs in the range or
+	// if IDs in the range may have already been allocated.
+	AllocateKeyRange(key Key, start, end int64) error
+}
+
+// AllocateKeyRange calls AllocateKeyRange on ds if it implements
+// KeyRangeAllocator and returns an error if it does not.
+func AllocateKeyRange(ds Datastore, key Key, start, end int64) error {
+	kra, ok := ds.(KeyRangeAllocator)
+	if !ok {
+		return fmt.Errorf("datastore: %T does not support AllocateKeyRange",
+			ds)
+	}
+	return kra.AllocateKeyRange(key, start, end)
+}
+
+// ErrFieldMismatch is returned when a property cannot be loaded into a
+// struct, either because the struct has no field for it or because its value
+// cannot be assigned to the field. It is the equivalent of the official
+// package's ErrFieldMismatch and, as in production, the other properties are
+// still loaded.
+type ErrFieldMismatch struct {
+	StructType reflect.Type
+	FieldName  string
+	Reason     string
+}
+
+func (e *ErrFieldMismatch) Error() string {
+	return fmt.Sprintf("datastore: cannot load field %q into a %q: %s",
+		e.FieldName, e.StructType, e.Reason)
+}
+
 // Iterator is used to get entities from the datastore. A new instance can be
 // created by calling Run from the Datastore service.
 type Iterator interface {
@@ -184,6 +229,8 @@ type Iterator interface {
 	// Next returns the next entity and key pair from the iterator. Unlike the
 	// official google.golang.org/appengine/datastore.Iterator implementation,
 	// the returned key will be nil to signify no more iterables to return.
+	// Like Get, an *ErrFieldMismatch is returned with the key if a property
+	// cannot be loaded into entity.
 	Next(entity interface{}) (Key, error)
 }
 
@@ -233,6 +280,12 @@ type Order struct {
 	Dir  OrderDir
 }
 
+// GeoPoint represents a location as latitude and longitude in degrees. It is
+// the equivalent of appengine.GeoPoint.
+type GeoPoint struct {
+	Lat, Lng float64
+}
+
 // KeyName is the special name given to the key property of an entity.
 // Using this as the name in query orders or filters will apply the operation
 // to the entity key, not one of its properties.
@@ -0,0 +1,40 @@
+/*
+Package faultds wraps any datastore.TransactionalDatastore, such as memds or
+ds, and injects errors and latency into its operations so the way code copes
+with a misbehaving datastore can be tested.
+
+Faults are described by rules that match operations by type, kind and key
+pattern:
+
+	ds := faultds.New(memds.New(), faultds.Config{
+		Seed: 1,
+		Rules: []faultds.Rule{{
+			Ops:         []faultds.Op{faultds.PutOp},
+			Kind:        "Order",
+			Probability: 0.1,
+			Err:         faultds.ErrTimeout,
+		}, {
+			Ops:   []faultds.Op{faultds.CommitOp},
+			Limit: 2,
+			Err:   faultds.ErrConcurrentTransaction,
+		}},
+	})
+
+Rules are evaluated with a random source created from Seed so the same faults
+are injected every time a test is run.
+
+Key patterns
+
+A key pattern is matched against the path of a key with path.Match. Each
+element of the path is written as kind:id and elements are separated by a
+slash, so the pattern "Company:acme/Employee:*" matches every Employee whose
+parent is the Company acme. Incomplete keys have an empty id.
+
+Partial errors
+
+A rule with PerKey set fails individual keys of Get, Put and Delete. The keys
+that are not failed are passed to the wrapped datastore and a MultiError is
+returned with an error for each key, like the official datastore package does
+when only some keys fail.
+*/
+package faultds
@@ -0,0 +1,561 @@
+package faultds
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qedus/appengine/datastore"
+)
+
+var (
+	// ErrTimeout is a stand in for the timeout errors production returns when
+	// an operation takes too long or there is too much contention.
+	ErrTimeout = errors.New("faultds: datastore timeout")
+
+	// ErrConcurrentTransaction is a stand in for the error production returns
+	// when a transaction fails to commit because of concurrent writes. Rules
+	// can use the official package's ErrConcurrentTransaction instead when
+	// the code under test compares against it.
+	ErrConcurrentTransaction = errors.New(
+		"faultds: transaction failed due to concurrent writes")
+
+	// ErrInternal is a stand in for production's internal errors.
+	ErrInternal = errors.New("faultds: internal datastore error")
+
+	// ErrNoSuchEntity is the error in a MultiError for a key that was not
+	// found by the wrapped datastore.
+	ErrNoSuchEntity = errors.New("faultds: no such entity")
+)
+
+// MultiError is returned by Get, Put and Delete when a PerKey rule fails some
+// of the keys. Each element is the error for the key with the same index or
+// nil if there was no error.
+type MultiError []error
+
+func (me MultiError) Error() string {
+	n, first := 0, error(nil)
+	for _, err := range me {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			n++
+		}
+	}
+	switch n {
+	case 0:
+		return "faultds: no errors"
+	case 1:
+		return first.Error()
+	}
+	return fmt.Sprintf("%s (and %d other errors)", first, n-1)
+}
+
+// NotFound returns true if the wrapped datastore did not find the entity at
+// index so a MultiError can be checked like any other Get error.
+func (me MultiError) NotFound(index int) bool {
+	return me[index] == ErrNoSuchEntity
+}
+
+// Op is a type of datastore operation that faults can be injected into.
+type Op int
+
+const (
+	// GetOp is a call to Get.
+	GetOp Op = iota
+
+	// PutOp is a call to Put.
+	PutOp
+
+	// DeleteOp is a call to Delete.
+	DeleteOp
+
+	// AllocateKeysOp is a call to AllocateKeys.
+	AllocateKeysOp
+
+	// AllocateKeyRangeOp is a call to AllocateKeyRange.
+	AllocateKeyRangeOp
+
+	// RunOp is a call to Run.
+	RunOp
+
+	// NextOp is a call to Next on an iterator returned by Run.
+	NextOp
+
+	// CommitOp is the commit of a transaction after the function passed to
+	// RunInTransaction has returned without error. A fault discards the
+	// transaction's writes.
+	CommitOp
+)
+
+// Rule describes a fault to inject into matching operations.
+type Rule struct {
+
+	// Ops are the operations the rule applies to. No Ops applies the rule to
+	// every operation.
+	Ops []Op
+
+	// Kind limits the rule to keys or queries of a kind. An empty Kind
+	// matches every kind.
+	Kind string
+
+	// KeyPattern limits the rule to keys whose path matches the pattern. Run
+	// and Next match against the query's ancestor and the returned key
+	// respectively. CommitOp matches against the keys written by the
+	// transaction. An empty KeyPattern matches every key.
+	KeyPattern string
+
+	// Probability is the chance of the rule being applied to a matching
+	// operation. Zero applies the rule every time.
+	Probability float64
+
+	// Limit is the maximum number of times the rule is applied, which is
+	// useful to fail the first attempts of code that retries. Zero applies
+	// the rule without limit.
+	Limit int
+
+	// PerKey applies the rule to each key of Get, Put and Delete separately
+	// so only some keys fail with a MultiError. It has no effect on other
+	// operations.
+	PerKey bool
+
+	// Err is returned by the operation when the rule is applied. A nil Err
+	// only adds latency.
+	Err error
+
+	// Latency is added to the operation when the rule is applied.
+	Latency time.Duration
+}
+
+func (r *Rule) matchesOp(op Op) bool {
+	if len(r.Ops) == 0 {
+		return true
+	}
+	for _, o := range r.Ops {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// matches returns true if the rule applies to t.
+func (r *Rule) matches(t target) bool {
+	if r.Kind != "" && r.Kind != t.kind {
+		return false
+	}
+	if r.KeyPattern == "" {
+		return true
+	} else if t.key == nil {
+		return false
+	}
+	matched, _ := path.Match(r.KeyPattern, keyPath(t.key))
+	return matched
+}
+
+// keyPath returns the path of key as it is matched by key patterns.
+func keyPath(key datastore.Key) string {
+	elems := []string{}
+	for ; key != nil; key = key.Parent() {
+		elem := key.Kind() + ":"
+		switch id := key.ID().(type) {
+		case int64:
+			elem += strconv.FormatInt(id, 10)
+		case string:
+			elem += id
+		}
+		elems = append([]string{elem}, elems...)
+	}
+	return strings.Join(elems, "/")
+}
+
+// Config is used to configure a datastore created with New.
+type Config struct {
+
+	// Rules are the faults to inject. Every matching rule is applied to an
+	// operation. If more than one returns an error the first rule's error is
+	// used and latencies are added together.
+	Rules []Rule
+
+	// Seed seeds the random source used for rule probabilities.
+	Seed int64
+
+	// Sleep is used to add latency. A nil Sleep uses time.Sleep.
+	Sleep func(time.Duration)
+}
+
+// faults decides which rules are applied to each operation.
+type faults struct {
+	rules []Rule
+	sleep func(time.Duration)
+
+	mu      sync.Mutex
+	rand    *rand.Rand
+	applied []int
+}
+
+// apply reports whether rule i is applied to an operation that it matches.
+// f.mu must be held.
+func (f *faults) apply(i int) bool {
+	r := &f.rules[i]
+	if r.Limit > 0 && f.applied[i] >= r.Limit {
+		return false
+	}
+	if r.Probability > 0 && r.Probability < 1 &&
+		f.rand.Float64() >= r.Probability {
+		return false
+	}
+	f.applied[i]++
+	return true
+}
+
+// target is what an operation acts on. key can be nil if the operation
+// only has a kind.
+type target struct {
+	kind string
+	key  datastore.Key
+}
+
+func keyTargets(keys []datastore.Key) []target {
+	targets := make([]target, len(keys))
+	for i, key := range keys {
+		targets[i] = target{key.Kind(), key}
+	}
+	return targets
+}
+
+// check applies the rules to an operation on targets and waits for any
+// injected latency. err is the error for the whole operation. If perKey is
+// true PerKey rules are applied to each target separately and keyErrs holds
+// an error for each target they failed. keyErrs is nil if no targets failed.
+func (f *faults) check(op Op, targets []target, perKey bool) (
+	err error, keyErrs []error) {
+
+	if len(targets) == 0 {
+		targets = []target{{}}
+		perKey = false
+	}
+	latency := time.Duration(0)
+
+	f.mu.Lock()
+	for i := range f.rules {
+		r := &f.rules[i]
+		if !r.matchesOp(op) {
+			continue
+		}
+
+		if r.PerKey && perKey {
+			applied := false
+			for j, t := range targets {
+				if !r.matches(t) || !f.apply(i) {
+					continue
+				}
+				applied = true
+				if r.Err == nil {
+					continue
+				}
+				if keyErrs == nil {
+					keyErrs = make([]error, len(targets))
+				}
+				if keyErrs[j] == nil {
+					keyErrs[j] = r.Err
+				}
+			}
+			if applied {
+				latency += r.Latency
+			}
+			continue
+		}
+
+		matched := false
+		for _, t := range targets {
+			if r.matches(t) {
+				matched = true
+				break
+			}
+		}
+		if !matched || !f.apply(i) {
+			continue
+		}
+		latency += r.Latency
+		if err == nil {
+			err = r.Err
+		}
+	}
+	f.mu.Unlock()
+
+	if latency > 0 {
+		f.sleep(latency)
+	}
+	return err, keyErrs
+}
+
+// New returns a datastore that injects the faults described by cfg into the
+// operations of ds.
+func New(ds datastore.TransactionalDatastore,
+	cfg Config) datastore.TransactionalDatastore {
+
+	sleep := cfg.Sleep
+	if sleep == nil {
+		sleep = time.Sleep
+	}
+
+	return &transactionalDs{
+		faultDs: &faultDs{
+			ds: ds,
+			faults: &faults{
+				rules:   append([]Rule{}, cfg.Rules...),
+				sleep:   sleep,
+				rand:    rand.New(rand.NewSource(cfg.Seed)),
+				applied: make([]int, len(cfg.Rules)),
+			},
+		},
+		tds: ds,
+	}
+}
+
+// faultDs injects faults into the operations of a datastore.Datastore.
+type faultDs struct {
+	ds     datastore.Datastore
+	faults *faults
+
+	// tx is true within a transaction, in which case written records the
+	// keys written so CommitOp rules can match them.
+	tx      bool
+	written []datastore.Key
+}
+
+func (ds *faultDs) record(keys []datastore.Key) {
+	if ds.tx {
+		ds.written = append(ds.written, keys...)
+	}
+}
+
+// succeeded returns the indexes of the keys that did not fail.
+func succeeded(keyErrs []error) []int {
+	indexes := []int{}
+	for i, err := range keyErrs {
+		if err == nil {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+func subsetKeys(keys []datastore.Key, indexes []int) []datastore.Key {
+	subset := make([]datastore.Key, len(indexes))
+	for j, i := range indexes {
+		subset[j] = keys[i]
+	}
+	return subset
+}
+
+// subsetValues returns a new slice of the same type as values that holds the
+// elements at indexes.
+func subsetValues(values reflect.Value, indexes []int) reflect.Value {
+	subset := reflect.MakeSlice(values.Type(), len(indexes), len(indexes))
+	for j, i := range indexes {
+		subset.Index(j).Set(values.Index(i))
+	}
+	return subset
+}
+
+func verifyKeysValues(keys []datastore.Key, values reflect.Value) error {
+	if values.Kind() != reflect.Slice {
+		return errors.New("faultds: entities must be a slice")
+	}
+	if len(keys) != values.Len() {
+		return errors.New("faultds: keys and entities must be the same length")
+	}
+	return nil
+}
+
+func (ds *faultDs) Get(keys []datastore.Key, entities interface{}) error {
+	err, keyErrs := ds.faults.check(GetOp, keyTargets(keys), true)
+	if err != nil {
+		return err
+	} else if keyErrs == nil {
+		return ds.ds.Get(keys, entities)
+	}
+
+	values := reflect.ValueOf(entities)
+	if err := verifyKeysValues(keys, values); err != nil {
+		return err
+	}
+
+	indexes := succeeded(keyErrs)
+	if len(indexes) == 0 {
+		return MultiError(keyErrs)
+	}
+
+	subset := subsetValues(values, indexes)
+	if err := ds.ds.Get(subsetKeys(keys, indexes),
+		subset.Interface()); err != nil {
+
+		nfe, ok := err.(interface {
+			NotFound(index int) bool
+		})
+		if !ok {
+			return err
+		}
+		for j, i := range indexes {
+			if nfe.NotFound(j) {
+				keyErrs[i] = ErrNoSuchEntity
+			}
+		}
+	}
+
+	// Copy back the entities in case they are []S rather than []*S.
+	for j, i := range indexes {
+		values.Index(i).Set(subset.Index(j))
+	}
+	return MultiError(keyErrs)
+}
+
+func (ds *faultDs) Put(keys []datastore.Key, entities interface{}) (
+	[]datastore.Key, error) {
+
+	err, keyErrs := ds.faults.check(PutOp, keyTargets(keys), true)
+	if err != nil {
+		return nil, err
+	} else if keyErrs == nil {
+		completeKeys, err := ds.ds.Put(keys, entities)
+		if err != nil {
+			return nil, err
+		}
+		ds.record(completeKeys)
+		return completeKeys, nil
+	}
+
+	values := reflect.ValueOf(entities)
+	if err := verifyKeysValues(keys, values); err != nil {
+		return nil, err
+	}
+
+	// The keys that failed are returned as nil keys.
+	completeKeys := make([]datastore.Key, len(keys))
+	indexes := succeeded(keyErrs)
+	if len(indexes) > 0 {
+		putKeys, err := ds.ds.Put(subsetKeys(keys, indexes),
+			subsetValues(values, indexes).Interface())
+		if err != nil {
+			return nil, err
+		}
+		ds.record(putKeys)
+		for j, i := range indexes {
+			completeKeys[i] = putKeys[j]
+		}
+	}
+	return completeKeys, MultiError(keyErrs)
+}
+
+func (ds *faultDs) Delete(keys []datastore.Key) error {
+	err, keyErrs := ds.faults.check(DeleteOp, keyTargets(keys), true)
+	if err != nil {
+		return err
+	} else if keyErrs == nil {
+		if err := ds.ds.Delete(keys); err != nil {
+			return err
+		}
+		ds.record(keys)
+		return nil
+	}
+
+	indexes := succeeded(keyErrs)
+	if len(indexes) > 0 {
+		deleteKeys := subsetKeys(keys, indexes)
+		if err := ds.ds.Delete(deleteKeys); err != nil {
+			return err
+		}
+		ds.record(deleteKeys)
+	}
+	return MultiError(keyErrs)
+}
+
+func (ds *faultDs) AllocateKeys(key datastore.Key, n int) (
+	[]datastore.Key, error) {
+
+	targets := keyTargets([]datastore.Key{key})
+	if err, _ := ds.faults.check(AllocateKeysOp, targets, false); err != nil {
+		return nil, err
+	}
+	return ds.ds.AllocateKeys(key, n)
+}
+
+func (ds *faultDs) AllocateKeyRange(key datastore.Key,
+	start, end int64) error {
+
+	targets := keyTargets([]datastore.Key{key})
+	err, _ := ds.faults.check(AllocateKeyRangeOp, targets, false)
+	if err != nil {
+		return err
+	}
+	return datastore.AllocateKeyRange(ds.ds, key, start, end)
+}
+
+func (ds *faultDs) Run(q datastore.Query) (datastore.Iterator, error) {
+	targets := []target{{q.Kind, q.Ancestor}}
+	if err, _ := ds.faults.check(RunOp, targets, false); err != nil {
+		return nil, err
+	}
+
+	iter, err := ds.ds.Run(q)
+	if err != nil {
+		return nil, err
+	}
+	return &iterator{
+		iter:   iter,
+		faults: ds.faults,
+	}, nil
+}
+
+type iterator struct {
+	iter   datastore.Iterator
+	faults *faults
+}
+
+func (it *iterator) Next(entity interface{}) (datastore.Key, error) {
+	key, err := it.iter.Next(entity)
+	if err != nil || key == nil {
+		return key, err
+	}
+
+	targets := []target{{key.Kind(), key}}
+	if err, _ := it.faults.check(NextOp, targets, false); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+type transactionalDs struct {
+	*faultDs
+	tds datastore.TransactionalDatastore
+}
+
+func (ds *transactionalDs) RunInTransaction(
+	f func(datastore.Datastore) error) error {
+
+	return ds.tds.RunInTransaction(func(tx datastore.Datastore) error {
+		txDs := &faultDs{
+			ds:     tx,
+			faults: ds.faults,
+			tx:     true,
+		}
+		if err := f(txDs); err != nil {
+			return err
+		}
+
+		// Failing the commit from within the transaction function makes the
+		// wrapped datastore discard the transaction's writes.
+		targets := keyTargets(txDs.written)
+		err, _ := ds.faults.check(CommitOp, targets, false)
+		return err
+	})
+}
@@ -0,0 +1,228 @@
+package faultds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qedus/appengine/datastore"
+	"github.com/qedus/appengine/datastore/faultds"
+	"github.com/qedus/appengine/datastore/memds"
+)
+
+type Entity struct {
+	Value int64
+}
+
+func TestKindRule(t *testing.T) {
+	ds := faultds.New(memds.New(), faultds.Config{
+		Rules: []faultds.Rule{{
+			Ops:  []faultds.Op{faultds.PutOp},
+			Kind: "Order",
+			Err:  faultds.ErrTimeout,
+		}},
+	})
+
+	orderKey := datastore.NewKey("").IntID("Order", 1)
+	if _, err := ds.Put([]datastore.Key{orderKey},
+		[]Entity{{1}}); err != faultds.ErrTimeout {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+
+	userKey := datastore.NewKey("").IntID("User", 1)
+	if _, err := ds.Put([]datastore.Key{userKey},
+		[]Entity{{1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only puts are failed.
+	if err := ds.Get([]datastore.Key{orderKey},
+		make([]Entity, 1)); !isNotFound(err, 0) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
+
+func isNotFound(err error, index int) bool {
+	nfe, ok := err.(interface {
+		NotFound(index int) bool
+	})
+	return ok && nfe.NotFound(index)
+}
+
+func TestPerKeyRule(t *testing.T) {
+	mds := memds.New()
+	ds := faultds.New(mds, faultds.Config{
+		Rules: []faultds.Rule{{
+			KeyPattern: "Company:acme/Employee:*",
+			PerKey:     true,
+			Err:        faultds.ErrInternal,
+		}},
+	})
+
+	root := datastore.NewKey("")
+	keys := []datastore.Key{
+		root.StringID("Company", "acme").IntID("Employee", 1),
+		root.StringID("Company", "other").IntID("Employee", 1),
+		root.StringID("Company", "other").IntID("Employee", 2),
+	}
+
+	completeKeys, err := ds.Put(keys[:2], []Entity{{1}, {2}})
+	me, ok := err.(faultds.MultiError)
+	if !ok {
+		t.Fatalf("expected multi error, got %v", err)
+	}
+	if me[0] != faultds.ErrInternal || me[1] != nil {
+		t.Fatalf("unexpected errors %v", me)
+	}
+	if completeKeys[0] != nil || !completeKeys[1].Equal(keys[1]) {
+		t.Fatalf("unexpected keys %v", completeKeys)
+	}
+	if mds.Has(keys[0]) || !mds.Has(keys[1]) {
+		t.Fatal("expected only the second entity to be put")
+	}
+
+	entities := make([]*Entity, 3)
+	for i := range entities {
+		entities[i] = &Entity{}
+	}
+	err = ds.Get(keys, entities)
+	me, ok = err.(faultds.MultiError)
+	if !ok {
+		t.Fatalf("expected multi error, got %v", err)
+	}
+	if me[0] != faultds.ErrInternal || me[1] != nil ||
+		me[2] != faultds.ErrNoSuchEntity {
+		t.Fatalf("unexpected errors %v", me)
+	}
+	if me.NotFound(0) || me.NotFound(1) || !me.NotFound(2) {
+		t.Fatal("incorrect not found")
+	}
+	if entities[1].Value != 2 {
+		t.Fatalf("expected entity to be loaded, got %+v", entities[1])
+	}
+}
+
+func TestCommitLimit(t *testing.T) {
+	mds := memds.New()
+	ds := faultds.New(mds, faultds.Config{
+		Rules: []faultds.Rule{{
+			Ops:   []faultds.Op{faultds.CommitOp},
+			Kind:  "Counter",
+			Limit: 2,
+			Err:   faultds.ErrConcurrentTransaction,
+		}},
+	})
+
+	key := datastore.NewKey("").StringID("Counter", "hits")
+	increment := func(tx datastore.Datastore) error {
+		_, err := tx.Put([]datastore.Key{key}, []Entity{{1}})
+		return err
+	}
+
+	for i := 0; i < 2; i++ {
+		err := ds.RunInTransaction(increment)
+		if err != faultds.ErrConcurrentTransaction {
+			t.Fatalf("attempt %d: expected concurrent transaction, got %v",
+				i, err)
+		}
+		if mds.Has(key) {
+			t.Fatal("expected failed commit to be discarded")
+		}
+	}
+
+	if err := ds.RunInTransaction(increment); err != nil {
+		t.Fatal(err)
+	}
+	if !mds.Has(key) {
+		t.Fatal("expected commit to succeed after limit")
+	}
+}
+
+func TestIteratorRule(t *testing.T) {
+	ds := faultds.New(memds.New(), faultds.Config{
+		Rules: []faultds.Rule{{
+			Ops:        []faultds.Op{faultds.NextOp},
+			KeyPattern: "Entity:2",
+			Err:        faultds.ErrTimeout,
+		}},
+	})
+
+	root := datastore.NewKey("")
+	keys := []datastore.Key{root.IntID("Entity", 1), root.IntID("Entity", 2)}
+	if _, err := ds.Put(keys, []Entity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	iter, err := ds.Run(datastore.Query{
+		Kind: "Entity",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entity := &Entity{}
+	if key, err := iter.Next(entity); err != nil {
+		t.Fatal(err)
+	} else if !key.Equal(keys[0]) {
+		t.Fatalf("unexpected key %v", key)
+	}
+	if _, err := iter.Next(entity); err != faultds.ErrTimeout {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	run := func(seed int64) []bool {
+		ds := faultds.New(memds.New(), faultds.Config{
+			Seed: seed,
+			Rules: []faultds.Rule{{
+				Probability: 0.5,
+				Err:         faultds.ErrTimeout,
+			}},
+		})
+
+		failed := make([]bool, 50)
+		for i := range failed {
+			_, err := ds.AllocateKeys(
+				datastore.NewKey("").IncompleteID("Entity"), 1)
+			failed[i] = err != nil
+		}
+		return failed
+	}
+
+	first, second := run(1), run(1)
+	failures := 0
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("failure %d differs between runs", i)
+		}
+		if first[i] {
+			failures++
+		}
+	}
+	if failures == 0 || failures == len(first) {
+		t.Fatalf("expected some failures, got %d", failures)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	slept := time.Duration(0)
+	ds := faultds.New(memds.New(), faultds.Config{
+		Rules: []faultds.Rule{{
+			Ops:     []faultds.Op{faultds.DeleteOp},
+			Latency: time.Second,
+		}, {
+			Kind:    "Entity",
+			Latency: time.Minute,
+		}},
+		Sleep: func(d time.Duration) {
+			slept += d
+		},
+	})
+
+	key := datastore.NewKey("").IntID("Entity", 1)
+	if err := ds.Delete([]datastore.Key{key}); err != nil {
+		t.Fatal(err)
+	}
+	if slept != time.Minute+time.Second {
+		t.Fatalf("expected latencies to be added, got %v", slept)
+	}
+}
@@ -0,0 +1,45 @@
+/*
+Package fixture seeds any datastore.Datastore from JSON or YAML documents so
+the same fixtures can be used with memds and a dev_appserver.py backed ds.
+
+A fixture document is a list of entities:
+
+	- namespace: ns
+	  parent: [Company, acme]
+	  kind: Employee
+	  id: 12
+	  properties:
+	  - name: Name
+	    string: Ada
+	  - name: Salary
+	    int: 100
+	  - name: Rating
+	    float: 4.5
+	  - name: Active
+	    bool: true
+	  - name: Joined
+	    time: 2016-07-15T10:00:00Z
+	  - name: Manager
+	    key: [Company, acme, Employee, 1]
+	  - name: Photo
+	    bytes: aGkgdGhlcmU=
+	  - name: Skills
+	    list:
+	    - string: go
+	    - string: python
+	  - name: Notes
+	    string: not searchable
+	    noindex: true
+
+The same document can be written as JSON. Key paths alternate between kinds
+and IDs where an integer is an integer ID and anything else is a string ID.
+Key property values are in the namespace of the entity. An entity without an
+id will be given an automatically allocated integer ID. Times are in RFC 3339
+format and bytes are base64 encoded. All elements of a list must have the
+same type.
+
+Fixtures can be loaded into any backend:
+
+	keys, err := fixture.LoadFile(memds.New(), "testdata/employees.yaml")
+*/
+package fixture
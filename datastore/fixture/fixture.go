@@ -0,0 +1,264 @@
+package fixture
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/qedus/appengine/datastore"
+	"gopkg.in/yaml.v2"
+)
+
+// maxPut is the maximum number of entities App Engine allows in a single put.
+const maxPut = 500
+
+type value struct {
+	Int    *int64        `yaml:"int"`
+	Float  *float64      `yaml:"float"`
+	Bool   *bool         `yaml:"bool"`
+	String *string       `yaml:"string"`
+	Time   *string       `yaml:"time"`
+	Key    []interface{} `yaml:"key"`
+	Bytes  *string       `yaml:"bytes"`
+	List   []value       `yaml:"list"`
+}
+
+type property struct {
+	Name    string `yaml:"name"`
+	value   `yaml:",inline"`
+	NoIndex bool `yaml:"noindex"`
+}
+
+type entity struct {
+	Namespace  string        `yaml:"namespace"`
+	Parent     []interface{} `yaml:"parent"`
+	Kind       string        `yaml:"kind"`
+	ID         interface{}   `yaml:"id"`
+	Properties []property    `yaml:"properties"`
+}
+
+var keyType = reflect.TypeOf((*datastore.Key)(nil)).Elem()
+
+func appendPath(key datastore.Key, path []interface{}) (datastore.Key, error) {
+	if len(path)%2 != 0 {
+		return nil, errors.New("fixture: key path must be kind and ID pairs")
+	}
+
+	for i := 0; i < len(path); i += 2 {
+		kind, ok := path[i].(string)
+		if !ok || kind == "" {
+			return nil, fmt.Errorf("fixture: invalid key kind %v", path[i])
+		}
+
+		switch id := path[i+1].(type) {
+		case int:
+			key = key.IntID(kind, int64(id))
+		case int64:
+			key = key.IntID(kind, id)
+		case string:
+			key = key.StringID(kind, id)
+		default:
+			return nil, fmt.Errorf("fixture: invalid key ID %v", id)
+		}
+	}
+	return key, nil
+}
+
+// decode returns the Go value of v.
+func (v value) decode(namespace string) (reflect.Value, error) {
+	set := 0
+	var val reflect.Value
+	if v.Int != nil {
+		set++
+		val = reflect.ValueOf(*v.Int)
+	}
+	if v.Float != nil {
+		set++
+		val = reflect.ValueOf(*v.Float)
+	}
+	if v.Bool != nil {
+		set++
+		val = reflect.ValueOf(*v.Bool)
+	}
+	if v.String != nil {
+		set++
+		val = reflect.ValueOf(*v.String)
+	}
+	if v.Time != nil {
+		set++
+		t, err := time.Parse(time.RFC3339Nano, *v.Time)
+		if err != nil {
+			return val, err
+		}
+		val = reflect.ValueOf(t)
+	}
+	if v.Key != nil {
+		set++
+		key, err := appendPath(datastore.NewKey(namespace), v.Key)
+		if err != nil {
+			return val, err
+		}
+		val = reflect.New(keyType).Elem()
+		val.Set(reflect.ValueOf(key))
+	}
+	if v.Bytes != nil {
+		set++
+		b, err := base64.StdEncoding.DecodeString(*v.Bytes)
+		if err != nil {
+			return val, err
+		}
+		val = reflect.ValueOf(b)
+	}
+	if v.List != nil {
+		set++
+		if len(v.List) == 0 {
+			return val, errors.New("fixture: empty lists are not stored")
+		}
+
+		for i, elem := range v.List {
+			if elem.List != nil {
+				return val, errors.New("fixture: lists cannot be nested")
+			}
+			elemVal, err := elem.decode(namespace)
+			if err != nil {
+				return val, err
+			}
+			if i == 0 {
+				val = reflect.MakeSlice(reflect.SliceOf(elemVal.Type()),
+					0, len(v.List))
+			} else if elemVal.Type() != val.Type().Elem() {
+				return val, errors.New(
+					"fixture: list elements must have the same type")
+			}
+			val = reflect.Append(val, elemVal)
+		}
+	}
+
+	if set != 1 {
+		return val, errors.New("fixture: a value must have exactly one type")
+	}
+	return val, nil
+}
+
+// toStruct returns a pointer to a struct with a field for each property.
+func toStruct(namespace string, props []property) (interface{}, error) {
+	fields := make([]reflect.StructField, len(props))
+	values := make([]reflect.Value, len(props))
+	names := map[string]bool{}
+	for i, p := range props {
+		if p.Name == "" || strings.ContainsAny(p.Name, ",") {
+			return nil, fmt.Errorf("fixture: invalid property name %q", p.Name)
+		}
+		if names[p.Name] {
+			return nil, fmt.Errorf("fixture: duplicate property %s", p.Name)
+		}
+		names[p.Name] = true
+
+		val, err := p.decode(namespace)
+		if err != nil {
+			return nil, fmt.Errorf("fixture: property %s: %v", p.Name, err)
+		}
+
+		tag := p.Name
+		if p.NoIndex {
+			tag += ",noindex"
+		}
+		fields[i] = reflect.StructField{
+			Name: "F" + strconv.Itoa(i),
+			Type: val.Type(),
+			Tag:  reflect.StructTag("datastore:" + strconv.Quote(tag)),
+		}
+		values[i] = val
+	}
+
+	entity := reflect.New(reflect.StructOf(fields))
+	for i, val := range values {
+		entity.Elem().Field(i).Set(val)
+	}
+	return entity.Interface(), nil
+}
+
+func (e entity) key() (datastore.Key, error) {
+	if e.Kind == "" {
+		return nil, errors.New("fixture: entity has no kind")
+	}
+
+	parent, err := appendPath(datastore.NewKey(e.Namespace), e.Parent)
+	if err != nil {
+		return nil, err
+	}
+
+	switch id := e.ID.(type) {
+	case nil:
+		return parent.IncompleteID(e.Kind), nil
+	case int:
+		return parent.IntID(e.Kind, int64(id)), nil
+	case string:
+		return parent.StringID(e.Kind, id), nil
+	default:
+		return nil, fmt.Errorf("fixture: invalid ID %v", id)
+	}
+}
+
+// Load reads a JSON or YAML fixture document from r and puts every entity it
+// describes into ds. The complete keys of the entities are returned in the
+// same order as the document.
+func Load(ds datastore.Datastore, r io.Reader) ([]datastore.Key, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	entities := []entity{}
+	if err := yaml.Unmarshal(data, &entities); err != nil {
+		return nil, err
+	}
+
+	keys := make([]datastore.Key, len(entities))
+	values := make([]interface{}, len(entities))
+	for i, e := range entities {
+		key, err := e.key()
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = key
+
+		value, err := toStruct(e.Namespace, e.Properties)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+
+	completeKeys := make([]datastore.Key, 0, len(keys))
+	for i := 0; i < len(keys); i += maxPut {
+		end := i + maxPut
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		putKeys, err := ds.Put(keys[i:end], values[i:end])
+		if err != nil {
+			return nil, err
+		}
+		completeKeys = append(completeKeys, putKeys...)
+	}
+	return completeKeys, nil
+}
+
+// LoadFile puts the entities from a JSON or YAML fixture file into ds.
+func LoadFile(ds datastore.Datastore, filename string) ([]datastore.Key,
+	error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return Load(ds, bytes.NewReader(data))
+}
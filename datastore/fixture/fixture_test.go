@@ -0,0 +1,228 @@
+package fixture_test
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/qedus/appengine/datastore"
+	"github.com/qedus/appengine/datastore/fixture"
+	"github.com/qedus/appengine/datastore/memds"
+)
+
+const fixtureYAML = `
+- namespace: ns
+  parent: [Company, acme]
+  kind: Employee
+  id: 12
+  properties:
+  - name: Name
+    string: Ada
+  - name: Salary
+    int: 100
+  - name: Rating
+    float: 4.5
+  - name: Active
+    bool: true
+  - name: Joined
+    time: 2016-07-15T10:00:00Z
+  - name: Manager
+    key: [Company, acme, Employee, 1]
+  - name: Photo
+    bytes: aGkgdGhlcmU=
+  - name: Skills
+    list:
+    - string: go
+    - string: python
+  - name: Notes
+    string: not searchable
+    noindex: true
+
+- namespace: ns
+  kind: Company
+  id: acme
+`
+
+const fixtureJSON = `[
+	{
+		"kind": "Employee",
+		"properties": [
+			{"name": "Name", "string": "Grace"},
+			{"name": "Scores", "list": [{"int": 1}, {"int": 2}]}
+		]
+	}
+]`
+
+type employee struct {
+	Name    string
+	Salary  int64
+	Rating  float64
+	Active  bool
+	Joined  time.Time
+	Manager datastore.Key
+	Photo   []byte
+	Skills  []string
+	Notes   string
+}
+
+func TestLoadYAML(t *testing.T) {
+	ds := memds.New()
+
+	keys, err := fixture.Load(ds, strings.NewReader(fixtureYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedKeys := []datastore.Key{
+		datastore.NewKey("ns").StringID("Company", "acme").IntID(
+			"Employee", 12),
+		datastore.NewKey("ns").StringID("Company", "acme"),
+	}
+	if len(keys) != len(expectedKeys) {
+		t.Fatal("incorrect number of keys", len(keys))
+	}
+	for i, key := range keys {
+		if !key.Equal(expectedKeys[i]) {
+			t.Fatal("incorrect key", key)
+		}
+	}
+
+	e := &employee{}
+	if err := ds.Get(keys[:1], []*employee{e}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := employee{
+		Name:   "Ada",
+		Salary: 100,
+		Rating: 4.5,
+		Active: true,
+		Joined: time.Date(2016, 7, 15, 10, 0, 0, 0, time.UTC),
+		Manager: datastore.NewKey("ns").StringID("Company", "acme").IntID(
+			"Employee", 1),
+		Photo:  []byte("hi there"),
+		Skills: []string{"go", "python"},
+		Notes:  "not searchable",
+	}
+	if !e.Manager.Equal(expected.Manager) {
+		t.Fatal("incorrect manager", e.Manager)
+	}
+	e.Manager, expected.Manager = nil, nil
+	if !e.Joined.Equal(expected.Joined) {
+		t.Fatal("incorrect joined time", e.Joined)
+	}
+	e.Joined, expected.Joined = time.Time{}, time.Time{}
+	if !reflect.DeepEqual(*e, expected) {
+		t.Fatalf("incorrect entity %+v", e)
+	}
+
+	// Fixture properties should be queryable.
+	iter, err := ds.Run(datastore.Query{
+		Namespace: "ns",
+		Kind:      "Employee",
+		Filters: []datastore.Filter{
+			{"Skills", datastore.EqualOp, "python"},
+		},
+		KeysOnly: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, err := iter.Next(nil); err != nil {
+		t.Fatal(err)
+	} else if !keys[0].Equal(key) {
+		t.Fatal("incorrect key", key)
+	}
+}
+
+func TestLoadJSON(t *testing.T) {
+	ds := memds.New()
+
+	keys, err := fixture.Load(ds, bytes.NewBufferString(fixtureJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Incomplete() {
+		t.Fatal("expected a complete key", keys)
+	}
+
+	type testEntity struct {
+		Name   string
+		Scores []int64
+	}
+	e := &testEntity{}
+	if err := ds.Get(keys, []*testEntity{e}); err != nil {
+		t.Fatal(err)
+	}
+	if e.Name != "Grace" || !reflect.DeepEqual(e.Scores, []int64{1, 2}) {
+		t.Fatalf("incorrect entity %+v", e)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	docs := []string{
+		// No kind.
+		`[{"id": 1}]`,
+
+		// Two value types.
+		`[{"kind": "A", "properties": [{"name": "P", "int": 1, "bool": true}]}]`,
+
+		// Mixed list types.
+		`[{"kind": "A", "properties": [
+			{"name": "P", "list": [{"int": 1}, {"string": "a"}]}]}]`,
+
+		// Invalid key path.
+		`[{"kind": "A", "parent": ["B"]}]`,
+	}
+
+	for i, doc := range docs {
+		if _, err := fixture.Load(memds.New(),
+			strings.NewReader(doc)); err == nil {
+			t.Fatal(i, "expected an error")
+		}
+	}
+}
+
+func TestLoadListTypes(t *testing.T) {
+	ds := memds.New()
+
+	keys, err := fixture.Load(ds, strings.NewReader(`
+- kind: Test
+  id: 1
+  properties:
+  - name: Flags
+    list: [{bool: true}, {bool: false}]
+  - name: Times
+    list: [{time: 2016-07-15T10:00:00Z}]
+  - name: Keys
+    list: [{key: [Test, 2]}]
+  - name: Blobs
+    list: [{bytes: aGk=}, {bytes: dGhlcmU=}]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type listEntity struct {
+		Flags []bool
+		Times []time.Time
+		Keys  []datastore.Key
+		Blobs [][]byte
+	}
+	entities := make([]listEntity, 1)
+	if err := ds.Get(keys, entities); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := listEntity{
+		Flags: []bool{true, false},
+		Times: []time.Time{time.Date(2016, 7, 15, 10, 0, 0, 0, time.UTC)},
+		Keys:  []datastore.Key{datastore.NewKey("").IntID("Test", 2)},
+		Blobs: [][]byte{[]byte("hi"), []byte("there")},
+	}
+	if !reflect.DeepEqual(entities[0], expected) {
+		t.Fatalf("expected %+v got %+v", expected, entities[0])
+	}
+}
@@ -0,0 +1,228 @@
+package memds
+
+import (
+	"math/bits"
+	"math/rand"
+
+	"github.com/qedus/appengine/datastore"
+)
+
+const (
+	// maxSequentialID is the largest ID handed out by a sequence. Scattered
+	// IDs start after it so the two can never collide.
+	maxSequentialID = 1<<52 - 1
+
+	// maxScatteredCounter is the number of distinct scattered IDs.
+	maxScatteredCounter = 1<<51 - 1
+
+	// scatterShift aligns a scattered counter with the top bits of an int64
+	// before they are reversed.
+	scatterShift = 64 - 52 + 1
+)
+
+// sequence allocates sequential IDs for keys of one kind with the same
+// parent.
+type sequence struct {
+	namespace string
+	parent    datastore.Key
+	kind      string
+	last      int64
+
+	// dirty is true if last has changed since the sequence was persisted.
+	dirty bool
+}
+
+// sequenceKey returns a string that identifies the sequence for keys like
+// key so sequences can be found in a map. It is the keyString of the
+// incomplete key with the same parent and kind.
+func sequenceKey(key datastore.Key) string {
+	parent := key.Parent()
+	if parent == nil {
+		parent = datastore.NewKey(key.Namespace())
+	}
+	return keyString(parent.IncompleteID(key.Kind()))
+}
+
+func (s *sequence) matches(key datastore.Key) bool {
+	if s.namespace != key.Namespace() || s.kind != key.Kind() {
+		return false
+	}
+	parent := key.Parent()
+	if s.parent == nil || parent == nil {
+		return s.parent == nil && parent == nil
+	}
+	return s.parent.Equal(parent)
+}
+
+// allocator hands out integer IDs for incomplete keys. Like production,
+// AllocateKeys uses a separate sequence for each kind and parent whereas Put
+// can use large scattered IDs that are spread over the whole ID space.
+type allocator struct {
+	// sequences are in the order they were created and are indexed by their
+	// sequenceKey in byKey.
+	sequences []*sequence
+	byKey     map[string]*sequence
+
+	// dirty are the sequences whose last ID has changed since they were
+	// last taken by takeDirty.
+	dirty []*sequence
+
+	scatter bool
+	seed    int64
+	rand    *rand.Rand
+	counter *countingSource
+
+	// source is the source of rand if one was provided rather than seed.
+	source rand.Source
+}
+
+// countingSource counts the values taken from a source so the position of
+// the source can be saved and later restored by skipping that many values.
+type countingSource struct {
+	rand.Source
+	count int64
+}
+
+func (s *countingSource) Int63() int64 {
+	s.count++
+	return s.Source.Int63()
+}
+
+// skipTo takes values from s until count have been taken in total.
+func (s *countingSource) skipTo(count int64) {
+	for s.count < count {
+		s.Int63()
+	}
+}
+
+// newAllocator returns an allocator whose scattered IDs come from source or,
+// if source is nil, a source seeded with seed.
+func newAllocator(scatter bool, seed int64, source rand.Source) *allocator {
+	a := &allocator{
+		scatter: scatter,
+		seed:    seed,
+		source:  source,
+	}
+	if source == nil {
+		source = rand.NewSource(seed)
+	}
+	a.counter = &countingSource{
+		Source: source,
+	}
+	a.rand = rand.New(a.counter)
+	return a
+}
+
+// reset returns a new allocator with no sequences. The scattered IDs start
+// again from the seed unless a source was provided, which carries on.
+func (a *allocator) reset() *allocator {
+	r := newAllocator(a.scatter, a.seed, a.source)
+	if a.source != nil {
+		r.counter.count = a.counter.count
+	}
+	return r
+}
+
+// draws returns the number of values taken from the source of the scattered
+// IDs. Restoring it with skipTo ensures IDs are not handed out again.
+func (a *allocator) draws() int64 {
+	return a.counter.count
+}
+
+// fork returns an independent copy of a. The scattered IDs of the copy are
+// seeded from a so forks allocate different IDs to each other.
+func (a *allocator) fork() *allocator {
+	f := newAllocator(a.scatter, a.rand.Int63(), nil)
+	for _, s := range a.sequences {
+		seq := *s
+		seq.dirty = false
+		f.add(&seq)
+	}
+	return f
+}
+
+// add adds the sequence s, which must not already exist.
+func (a *allocator) add(s *sequence) {
+	if a.byKey == nil {
+		a.byKey = map[string]*sequence{}
+	}
+	base := s.parent
+	if base == nil {
+		base = datastore.NewKey(s.namespace)
+	}
+	a.sequences = append(a.sequences, s)
+	a.byKey[sequenceKey(base.IncompleteID(s.kind))] = s
+}
+
+// sequence returns the sequence for keys like key, creating it if required.
+func (a *allocator) sequence(key datastore.Key) *sequence {
+	if s, exists := a.byKey[sequenceKey(key)]; exists {
+		return s
+	}
+
+	s := &sequence{
+		namespace: key.Namespace(),
+		parent:    key.Parent(),
+		kind:      key.Kind(),
+	}
+	a.add(s)
+	return s
+}
+
+// setLast moves s on so last is the last ID it has allocated.
+func (a *allocator) setLast(s *sequence, last int64) {
+	s.last = last
+	if !s.dirty {
+		s.dirty = true
+		a.dirty = append(a.dirty, s)
+	}
+}
+
+// takeDirty returns the sequences that have changed since it was last called.
+func (a *allocator) takeDirty() []*sequence {
+	dirty := a.dirty
+	for _, s := range dirty {
+		s.dirty = false
+	}
+	a.dirty = nil
+	return dirty
+}
+
+// allocate reserves n sequential IDs for keys like key and returns the first.
+func (a *allocator) allocate(key datastore.Key, n int) int64 {
+	s := a.sequence(key)
+	first := s.last + 1
+	a.setLast(s, s.last+int64(n))
+	return first
+}
+
+// toScatteredID maps counter to an ID in the same range and with the same bit
+// reversal as production's scattered IDs.
+func toScatteredID(counter int64) int64 {
+	return maxSequentialID + 1 +
+		int64(bits.Reverse64(uint64(counter)<<scatterShift))
+}
+
+// autoID returns the ID that Put gives an incomplete key. used reports
+// whether an ID is already taken by an entity.
+func (a *allocator) autoID(key datastore.Key, used func(int64) bool) int64 {
+	if !a.scatter {
+		// Skip IDs that have been given to entities explicitly so they are
+		// not overwritten.
+		for {
+			id := a.allocate(key, 1)
+			if !used(id) {
+				return id
+			}
+		}
+	}
+
+	// The IDs depend only on the seed so they are the same every time a test
+	// is run.
+	for {
+		id := toScatteredID(a.rand.Int63n(maxScatteredCounter))
+		if !used(id) {
+			return id
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package memds_test
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/qedus/appengine/datastore"
+	"github.com/qedus/appengine/datastore/memds"
+)
+
+func TestAllocateKeysSequences(t *testing.T) {
+	ds := memds.New()
+
+	parent := datastore.NewKey("").StringID("Parent", "a")
+	keys := []datastore.Key{
+		datastore.NewKey("").IncompleteID("A"),
+		datastore.NewKey("").IncompleteID("B"),
+		datastore.NewKey("ns").IncompleteID("A"),
+		parent.IncompleteID("A"),
+	}
+
+	// Every kind and parent has its own sequence.
+	for i, key := range keys {
+		for j := int64(1); j <= 3; j++ {
+			allocated, err := ds.AllocateKeys(key, 1)
+			if err != nil {
+				t.Fatal(i, err)
+			}
+			if id := allocated[0].ID(); id != j {
+				t.Fatal(i, "expected ID", j, "got", id)
+			}
+		}
+	}
+}
+
+func TestIncompleteKeySkipsUsedIDs(t *testing.T) {
+	ds := memds.NewWithOptions(memds.Options{
+		ConsistencyPolicy: memds.RandomConsistencyPolicy(0, 1),
+	})
+
+	type testEntity struct {
+		Value int64
+	}
+
+	// The second entity is still pending when the incomplete key is put.
+	used := []datastore.Key{
+		datastore.NewKey("").IntID("K", 1),
+		datastore.NewKey("").IntID("K", 2),
+	}
+	if _, err := ds.Put(used[:1], []testEntity{{100}}); err != nil {
+		t.Fatal(err)
+	}
+	ds.ApplyPending()
+	if _, err := ds.Put(used[1:], []testEntity{{100}}); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := ds.Put([]datastore.Key{
+		datastore.NewKey("").IncompleteID("K"),
+	}, []testEntity{{200}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := keys[0].ID(); id != int64(3) {
+		t.Fatal("expected ID 3 got", id)
+	}
+
+	entities := make([]testEntity, len(used))
+	if err := ds.Get(used, entities); err != nil {
+		t.Fatal(err)
+	}
+	if entities[0].Value != 100 || entities[1].Value != 100 ||
+		ds.Len() != 3 {
+		t.Fatal("explicit IDs overwritten", entities, ds.Len())
+	}
+}
+
+func TestManySequences(t *testing.T) {
+	ds := memds.New()
+
+	// Each parent has its own sequence so they all start at 1.
+	type testEntity struct{}
+	keys := make([]datastore.Key, 20000)
+	for i := range keys {
+		parent := datastore.NewKey("").IntID("Parent", int64(i+1))
+		keys[i] = parent.IncompleteID("Child")
+	}
+	keys, err := ds.Put(keys, make([]testEntity, len(keys)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if id := key.ID(); id != int64(1) {
+			t.Fatal("expected ID 1 got", id)
+		}
+	}
+}
+
+func TestScatteredIDs(t *testing.T) {
+	putKeys := func(source rand.Source) []datastore.Key {
+		ds := memds.NewWithOptions(memds.Options{
+			ScatteredIDs: true,
+			Rand:         source,
+		})
+
+		type testEntity struct{}
+		keys := make([]datastore.Key, 100)
+		for i := range keys {
+			keys[i] = datastore.NewKey("").IncompleteID("Test")
+		}
+		keys, err := ds.Put(keys, make([]testEntity, len(keys)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keys
+	}
+
+	keys := putKeys(rand.NewSource(1))
+	ids := map[int64]bool{}
+	for _, key := range keys {
+		id := key.ID().(int64)
+		if id < 1<<52 || id >= 1<<52+1<<51 {
+			t.Fatal("ID not in the scattered range", id)
+		}
+		if ids[id] {
+			t.Fatal("duplicate ID", id)
+		}
+		ids[id] = true
+	}
+
+	// The same seed always gives the same IDs.
+	for i, key := range putKeys(rand.NewSource(1)) {
+		if !key.Equal(keys[i]) {
+			t.Fatal("expected", keys[i], "got", key)
+		}
+	}
+
+	// Without a source the IDs are still the same every time.
+	defaultKeys := putKeys(nil)
+	for i, key := range putKeys(nil) {
+		if !key.Equal(defaultKeys[i]) {
+			t.Fatal("expected", defaultKeys[i], "got", key)
+		}
+	}
+}
+
+func TestAllocateKeyRange(t *testing.T) {
+	ds := memds.New()
+
+	key := datastore.NewKey("").IncompleteID("Test")
+	if err := ds.AllocateKeyRange(key, 1, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	// Allocation continues after the reserved range.
+	keys, err := ds.AllocateKeys(key, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := keys[0].ID(); id != int64(11) {
+		t.Fatal("expected ID 11 got", id)
+	}
+
+	// The range overlaps IDs that have already been allocated.
+	if err := ds.AllocateKeyRange(key, 5, 20); err == nil {
+		t.Fatal("expected contention error")
+	}
+
+	type testEntity struct{}
+	if _, err := ds.Put([]datastore.Key{
+		datastore.NewKey("").IntID("Test", 100),
+	}, []testEntity{{}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.AllocateKeyRange(key, 100, 200); err == nil {
+		t.Fatal("expected collision error")
+	}
+
+	// Other kinds have their own range.
+	other := datastore.NewKey("").IncompleteID("Other")
+	if err := ds.AllocateKeyRange(other, 100, 200); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ds.AllocateKeyRange(key, 300, 299); err == nil {
+		t.Fatal("expected invalid range error")
+	}
+}
+
+func TestRandSource(t *testing.T) {
+	run := func(seed int64) ([]datastore.Key, int) {
+		// The policy uses Options.Rand when it is given no source.
+		ds := memds.NewWithOptions(memds.Options{
+			ScatteredIDs:      true,
+			Rand:              rand.NewSource(seed),
+			ConsistencyPolicy: memds.RandomConsistencyPolicySource(0.5, nil),
+		})
+
+		type testEntity struct{}
+		keys := make([]datastore.Key, 20)
+		for i := range keys {
+			keys[i] = datastore.NewKey("").IncompleteID("Test")
+		}
+		keys, err := ds.Put(keys, make([]testEntity, len(keys)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		iter, err := ds.Run(datastore.Query{
+			Kind:     "Test",
+			KeysOnly: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		visible := 0
+		for {
+			key, err := iter.Next(nil)
+			if err != nil {
+				t.Fatal(err)
+			} else if key == nil {
+				break
+			}
+			visible++
+		}
+		return keys, visible
+	}
+
+	keys, visible := run(1)
+	sameKeys, sameVisible := run(1)
+	for i, key := range sameKeys {
+		if !key.Equal(keys[i]) {
+			t.Fatal("expected", keys[i], "got", key)
+		}
+	}
+	if visible != sameVisible {
+		t.Fatal("expected", visible, "visible entities got", sameVisible)
+	}
+}
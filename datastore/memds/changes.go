@@ -0,0 +1,234 @@
+package memds
+
+import (
+	"time"
+
+	"github.com/qedus/appengine/datastore"
+)
+
+// Change is a committed write recorded in the change log.
+type Change struct {
+	Key datastore.Key
+
+	// Old is the entity before the write and is nil if there was no entity.
+	// New is the entity after the write and is nil for a delete.
+	Old, New *Entity
+
+	// TransactionID identifies the transaction the write was committed in.
+	// Transactions are numbered from one in the order they commit. Writes
+	// made outside a transaction have an ID of zero.
+	TransactionID int64
+
+	// Time is the clock time the write was committed.
+	Time time.Time
+}
+
+// change is a recorded write. Its entities are shared with the store and are
+// only copied when the change is read.
+type change struct {
+	key           datastore.Key
+	old, new      propertyList
+	transactionID int64
+	time          time.Time
+}
+
+func (c change) Change() Change {
+	ch := Change{
+		Key:           c.key,
+		TransactionID: c.transactionID,
+		Time:          c.time,
+	}
+	if c.old != nil {
+		e := newEntity(c.key, c.old)
+		ch.Old = &e
+	}
+	if c.new != nil {
+		e := newEntity(c.key, c.new)
+		ch.New = &e
+	}
+	return ch
+}
+
+// subscriber is called with the changes to the keys it matches. A nil match
+// matches every key.
+type subscriber struct {
+	id    int
+	match func(datastore.Key) bool
+	f     func(Change)
+}
+
+// committedEntity returns the committed entity with key including any write
+// that is still pending, or nil if there is none.
+func (ds *Datastore) committedEntity(key datastore.Key) propertyList {
+	for i := len(ds.pendingJobs) - 1; i >= 0; i-- {
+		mutations := ds.pendingJobs[i].mutations
+		for j := len(mutations) - 1; j >= 0; j-- {
+			if mutations[j].key.Equal(key) {
+				return mutations[j].entity
+			}
+		}
+	}
+
+	ke, exists := ds.store.get(key)
+	if !exists {
+		return nil
+	}
+	return ke.entity
+}
+
+// record adds mutations to the change log as they are committed if changes
+// are recorded and queues them to be passed to the subscribers by notify.
+func (ds *Datastore) record(mutations []mutation, transactionID int64) {
+	if !ds.recordChanges && len(ds.subscribers) == 0 {
+		return
+	}
+	now := ds.clock.Now()
+
+	// Later mutations of the same key replace earlier ones.
+	written := map[string]propertyList{}
+	changes := make([]change, len(mutations))
+	for i, m := range mutations {
+		ks := keyString(m.key)
+		old, exists := written[ks]
+		if !exists {
+			old = ds.committedEntity(m.key)
+		}
+		written[ks] = m.entity
+
+		changes[i] = change{
+			key:           m.key,
+			old:           old,
+			new:           m.entity,
+			transactionID: transactionID,
+			time:          now,
+		}
+	}
+	if ds.recordChanges {
+		ds.changes = append(ds.changes, changes...)
+	}
+	if len(ds.subscribers) > 0 {
+		ds.unnotified = append(ds.unnotified, changes...)
+	}
+}
+
+// notify passes the recorded changes to the subscribers once they have been
+// committed. Subscribers that write to the datastore have their changes
+// delivered after the changes that are already queued so every subscriber
+// sees changes in commit order. Only one goroutine delivers changes at a time
+// and subscribers are called without ds.mu held.
+func (ds *Datastore) notify() {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if ds.notifying {
+		return
+	}
+	ds.notifying = true
+
+	for len(ds.unnotified) > 0 {
+		c := ds.unnotified[0]
+		ds.unnotified = ds.unnotified[1:]
+
+		// Subscribers can cancel themselves while they are called.
+		subscribers := append([]subscriber{}, ds.subscribers...)
+		ds.mu.Unlock()
+		for _, s := range subscribers {
+			if s.match == nil || s.match(c.key) {
+				s.f(c.Change())
+			}
+		}
+		ds.mu.Lock()
+	}
+	ds.unnotified = nil
+	ds.notifying = false
+}
+
+// Changes returns every write committed by Put, Delete and RunInTransaction
+// in the order they were committed. Each write to a key is a separate change
+// even if it is within a transaction, and deleting a key that does not exist
+// is still recorded. Changes are only recorded by datastores created with
+// Options.RecordChanges.
+func (ds *Datastore) Changes() []Change {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	changes := make([]Change, len(ds.changes))
+	for i, c := range ds.changes {
+		changes[i] = c.Change()
+	}
+	return changes
+}
+
+// ClearChanges empties the change log, which is useful to only assert on the
+// writes made after a test has seeded the datastore.
+func (ds *Datastore) ClearChanges() {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	ds.changes = nil
+}
+
+// Subscribe calls f with every change once it has been committed. Calling the
+// returned cancel function stops f from being called. Subscribers are not
+// copied to forks.
+func (ds *Datastore) Subscribe(f func(Change)) (cancel func()) {
+	return ds.subscribe(nil, f)
+}
+
+func (ds *Datastore) subscribe(match func(datastore.Key) bool,
+	f func(Change)) (cancel func()) {
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	ds.nextSubscriberID++
+	id := ds.nextSubscriberID
+	ds.subscribers = append(ds.subscribers, subscriber{
+		id:    id,
+		match: match,
+		f:     f,
+	})
+
+	return func() {
+		ds.mu.Lock()
+		defer ds.mu.Unlock()
+		for i, s := range ds.subscribers {
+			if s.id == id {
+				ds.subscribers = append(ds.subscribers[:i:i],
+					ds.subscribers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// WatchKey calls f with each committed change to the entity with key. Like
+// Subscribe, f is only called for committed writes, after every write in the
+// same Put, Delete or transaction has been committed, and calling cancel
+// stops f from being called.
+func (ds *Datastore) WatchKey(key datastore.Key,
+	f func(Change)) (cancel func()) {
+	return ds.subscribe(key.Equal, f)
+}
+
+// WatchAncestor calls f with each committed change to ancestor or any entity
+// that has ancestor as a parent, grandparent and so on.
+func (ds *Datastore) WatchAncestor(ancestor datastore.Key,
+	f func(Change)) (cancel func()) {
+	return ds.subscribe(func(key datastore.Key) bool {
+		for ; key != nil; key = key.Parent() {
+			if ancestor.Equal(key) {
+				return true
+			}
+		}
+		return false
+	}, f)
+}
+
+// WatchKind calls f with each committed change to an entity of kind within
+// namespace.
+func (ds *Datastore) WatchKind(namespace, kind string,
+	f func(Change)) (cancel func()) {
+	return ds.subscribe(func(key datastore.Key) bool {
+		return key.Namespace() == namespace && key.Kind() == kind
+	}, f)
+}
@@ -0,0 +1,247 @@
+package memds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qedus/appengine/datastore"
+	"github.com/qedus/appengine/datastore/memds"
+)
+
+func TestChanges(t *testing.T) {
+	now := time.Unix(100, 0)
+	ds := memds.NewWithOptions(memds.Options{
+		Clock:             memds.NewManualClock(now),
+		ConsistencyPolicy: memds.RandomConsistencyPolicy(0, 1),
+		RecordChanges:     true,
+	})
+
+	type testEntity struct {
+		Value int64
+	}
+	key := datastore.NewKey("").IntID("Test", 1)
+	other := datastore.NewKey("").IntID("Test", 2)
+
+	if _, err := ds.Put([]datastore.Key{key},
+		[]testEntity{{1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.RunInTransaction(func(tx datastore.Datastore) error {
+		if _, err := tx.Put([]datastore.Key{key, other},
+			[]testEntity{{2}, {3}}); err != nil {
+			return err
+		}
+		return tx.Delete([]datastore.Key{key})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes that were not committed are not recorded.
+	ds.RunInTransaction(func(tx datastore.Datastore) error {
+		tx.Delete([]datastore.Key{other})
+		return memds.ErrTransactionExpired
+	})
+
+	value := func(e *memds.Entity) interface{} {
+		if e == nil {
+			return nil
+		}
+		return e.Properties["Value"]
+	}
+
+	expected := []struct {
+		key           datastore.Key
+		old, new      interface{}
+		transactionID int64
+	}{
+		{key, nil, int64(1), 0},
+		{key, int64(1), int64(2), 1},
+		{other, nil, int64(3), 1},
+		{key, int64(2), nil, 1},
+	}
+
+	changes := ds.Changes()
+	if len(changes) != len(expected) {
+		t.Fatal("expected", len(expected), "changes got", len(changes))
+	}
+	for i, e := range expected {
+		c := changes[i]
+		if !c.Key.Equal(e.key) {
+			t.Fatal(i, "expected key", e.key, "got", c.Key)
+		}
+		if v := value(c.Old); v != e.old {
+			t.Fatal(i, "expected old", e.old, "got", v)
+		}
+		if v := value(c.New); v != e.new {
+			t.Fatal(i, "expected new", e.new, "got", v)
+		}
+		if c.TransactionID != e.transactionID {
+			t.Fatal(i, "expected transaction", e.transactionID,
+				"got", c.TransactionID)
+		}
+		if !c.Time.Equal(now) {
+			t.Fatal(i, "expected time", now, "got", c.Time)
+		}
+	}
+
+	// Forks carry on from the same log without changing each other's.
+	fork := ds.Fork()
+	if err := fork.Delete([]datastore.Key{other}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.Delete([]datastore.Key{key}); err != nil {
+		t.Fatal(err)
+	}
+	forkChanges, changes := fork.Changes(), ds.Changes()
+	if len(forkChanges) != len(expected)+1 ||
+		len(changes) != len(expected)+1 {
+		t.Fatal("expected", len(expected)+1, "changes got",
+			len(forkChanges), len(changes))
+	}
+	if last := forkChanges[len(expected)]; !last.Key.Equal(other) {
+		t.Fatal("expected fork change to", other, "got", last.Key)
+	}
+	if last := changes[len(expected)]; !last.Key.Equal(key) {
+		t.Fatal("expected change to", key, "got", last.Key)
+	}
+
+	ds.ClearChanges()
+	if changes := ds.Changes(); len(changes) != 0 {
+		t.Fatal("expected no changes got", len(changes))
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	ds := memds.New()
+
+	received := []memds.Change{}
+	cancel := ds.Subscribe(func(c memds.Change) {
+		received = append(received, c)
+	})
+
+	key := datastore.NewKey("").IntID("Test", 1)
+	if err := ds.Delete([]datastore.Key{key}); err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 1 || !received[0].Key.Equal(key) ||
+		received[0].Old != nil || received[0].New != nil {
+		t.Fatal("unexpected changes", received)
+	}
+
+	cancel()
+	if err := ds.Delete([]datastore.Key{key}); err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 1 {
+		t.Fatal("expected no changes after cancel got", len(received))
+	}
+
+	// Subscribers do not need changes to be recorded.
+	if changes := ds.Changes(); len(changes) != 0 {
+		t.Fatal("expected no recorded changes got", len(changes))
+	}
+}
+
+func TestWatch(t *testing.T) {
+	ds := memds.New()
+
+	type testEntity struct {
+		Value int64
+	}
+	root := datastore.NewKey("")
+	parent := root.StringID("Parent", "a")
+	child := parent.IntID("Child", 1)
+	other := root.StringID("Parent", "b").IntID("Child", 1)
+
+	keyEvents, ancestorEvents, kindEvents := 0, 0, 0
+	ds.WatchKey(child, func(c memds.Change) {
+		keyEvents++
+	})
+	ds.WatchAncestor(parent, func(c memds.Change) {
+		ancestorEvents++
+	})
+	cancel := ds.WatchKind("", "Child", func(c memds.Change) {
+		kindEvents++
+	})
+
+	put := func(keys ...datastore.Key) {
+		if _, err := ds.Put(keys,
+			make([]testEntity, len(keys))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(parent, child, other, datastore.NewKey("ns").IntID("Child", 1))
+	if keyEvents != 1 || ancestorEvents != 2 || kindEvents != 2 {
+		t.Fatal("unexpected events", keyEvents, ancestorEvents, kindEvents)
+	}
+
+	// Transactions that fail to commit emit no events.
+	ds.RunInTransaction(func(tx datastore.Datastore) error {
+		tx.Delete([]datastore.Key{child})
+		return memds.ErrTransactionExpired
+	})
+	if keyEvents != 1 {
+		t.Fatal("expected no events for a failed transaction")
+	}
+
+	cancel()
+	put(child)
+	if keyEvents != 2 || kindEvents != 2 {
+		t.Fatal("unexpected events", keyEvents, kindEvents)
+	}
+}
+
+func TestWatchDenormaliser(t *testing.T) {
+	ds := memds.New()
+
+	type testEntity struct {
+		Value int64
+	}
+	source := datastore.NewKey("").IntID("Source", 1)
+	copied := datastore.NewKey("").IntID("Copy", 1)
+
+	// Copy every Source entity to a Copy entity, reading the committed
+	// entity rather than the change.
+	ds.WatchKind("", "Source", func(c memds.Change) {
+		entities := make([]testEntity, 1)
+		if err := ds.Get([]datastore.Key{c.Key}, entities); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ds.Put([]datastore.Key{copied},
+			entities); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	keys := []datastore.Key{}
+	ds.Subscribe(func(c memds.Change) {
+		keys = append(keys, c.Key)
+	})
+
+	if err := ds.RunInTransaction(func(tx datastore.Datastore) error {
+		_, err := tx.Put([]datastore.Key{source, source},
+			[]testEntity{{1}, {2}})
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	entities := make([]testEntity, 1)
+	if err := ds.Get([]datastore.Key{copied}, entities); err != nil {
+		t.Fatal(err)
+	}
+	if entities[0].Value != 2 {
+		t.Fatal("expected copied value 2 got", entities[0].Value)
+	}
+
+	// Every subscriber sees the changes in commit order.
+	expected := []datastore.Key{source, source, copied, copied}
+	if len(keys) != len(expected) {
+		t.Fatal("expected", len(expected), "changes got", len(keys))
+	}
+	for i, key := range expected {
+		if !keys[i].Equal(key) {
+			t.Fatal(i, "expected", key, "got", keys[i])
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package memds
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// defaultTransactionTimeout is how long production allows a transaction to
+// run before it expires.
+const defaultTransactionTimeout = 60 * time.Second
+
+// ErrTransactionExpired is returned by operations within a transaction and
+// by RunInTransaction once the transaction has run for longer than the
+// transaction timeout. The transaction's writes are discarded.
+var ErrTransactionExpired = errors.New("memds: transaction has expired")
+
+// Clock tells memds the current time. Options.Clock can be set to a
+// ManualClock so tests that depend on time never need to sleep.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// ManualClock is a Clock that only changes when it is told to.
+type ManualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewManualClock returns a ManualClock set to now.
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{
+		now: now,
+	}
+}
+
+// Now returns the time the clock is set to.
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Set sets the clock to now.
+func (c *ManualClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+// expired returns ErrTransactionExpired if the transaction has run for longer
+// than the datastore's transaction timeout.
+func (ds *txDs) expired() error {
+	if ds.ds.clock.Now().Sub(ds.start) > ds.ds.transactionTimeout {
+		return ErrTransactionExpired
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package memds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qedus/appengine/datastore"
+	"github.com/qedus/appengine/datastore/memds"
+)
+
+func TestTransactionExpiry(t *testing.T) {
+	clock := memds.NewManualClock(time.Unix(0, 0))
+	ds := memds.NewWithOptions(memds.Options{
+		Clock: clock,
+	})
+
+	type testEntity struct {
+		Value int64
+	}
+	key := datastore.NewKey("").IntID("Test", 1)
+
+	err := ds.RunInTransaction(func(tx datastore.Datastore) error {
+		if _, err := tx.Put([]datastore.Key{key},
+			[]testEntity{{1}}); err != nil {
+			return err
+		}
+		clock.Advance(time.Minute)
+		return nil
+	})
+	if err != nil {
+		t.Fatal("transaction should not expire at the timeout", err)
+	}
+
+	err = ds.RunInTransaction(func(tx datastore.Datastore) error {
+		if _, err := tx.Put([]datastore.Key{key},
+			[]testEntity{{2}}); err != nil {
+			return err
+		}
+		clock.Advance(time.Minute + time.Second)
+		return nil
+	})
+	if err != memds.ErrTransactionExpired {
+		t.Fatal("expected expired transaction, got", err)
+	}
+
+	entities := make([]testEntity, 1)
+	if err := ds.Get([]datastore.Key{key}, entities); err != nil {
+		t.Fatal(err)
+	}
+	if entities[0].Value != 1 {
+		t.Fatal("expected expired transaction to be discarded")
+	}
+
+	// Operations fail once the transaction has expired.
+	err = ds.RunInTransaction(func(tx datastore.Datastore) error {
+		clock.Advance(2 * time.Minute)
+		return tx.Get([]datastore.Key{key}, entities)
+	})
+	if err != memds.ErrTransactionExpired {
+		t.Fatal("expected expired get, got", err)
+	}
+}
+
+func TestTransactionTimeout(t *testing.T) {
+	clock := memds.NewManualClock(time.Unix(0, 0))
+	ds := memds.NewWithOptions(memds.Options{
+		Clock:              clock,
+		TransactionTimeout: time.Second,
+	})
+
+	err := ds.RunInTransaction(func(tx datastore.Datastore) error {
+		clock.Advance(2 * time.Second)
+		return tx.Delete([]datastore.Key{
+			datastore.NewKey("").IntID("Test", 1)})
+	})
+	if err != memds.ErrTransactionExpired {
+		t.Fatal("expected expired transaction, got", err)
+	}
+}
+
+func TestStatsClock(t *testing.T) {
+	now := time.Date(2016, 7, 15, 10, 0, 0, 0, time.UTC)
+	ds := memds.NewWithOptions(memds.Options{
+		Clock: memds.NewManualClock(now),
+	})
+	if err := ds.RecomputeStats(); err != nil {
+		t.Fatal(err)
+	}
+
+	type totalStat struct {
+		Timestamp time.Time `datastore:"timestamp"`
+	}
+	stats := make([]totalStat, 1)
+	if err := ignoreMismatch(ds.Get([]datastore.Key{
+		datastore.NewKey("").StringID("__Stat_Total__",
+			"total_entity_usage"),
+	}, stats)); err != nil {
+		t.Fatal(err)
+	}
+	if !stats[0].Timestamp.Equal(now) {
+		t.Fatal("expected clock timestamp, got", stats[0].Timestamp)
+	}
+}
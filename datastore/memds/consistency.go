@@ -0,0 +1,219 @@
+package memds
+
+import (
+	"math/rand"
+
+	"github.com/qedus/appengine/datastore"
+)
+
+// ConsistencyPolicy simulates the eventual consistency of the High
+// Replication datastore. Writes are grouped into jobs, one per entity group
+// per Put or Delete call. Jobs are applied in order for each entity group and
+// only applied jobs are visible to global (non-ancestor) queries. Gets and
+// ancestor queries always apply every pending job of the entity groups they
+// read so remain strongly consistent.
+type ConsistencyPolicy interface {
+
+	// Apply is called for every pending job, oldest first, each time a global
+	// query is run. It reports whether the job for the entity group with the
+	// specified root key should be applied. Once a job is not applied, later
+	// jobs for the same entity group are not offered until the next query.
+	Apply(root datastore.Key) bool
+}
+
+type randomPolicy struct {
+	probability float64
+	rand        *rand.Rand
+}
+
+func (p *randomPolicy) Apply(root datastore.Key) bool {
+	return p.rand.Float64() < p.probability
+}
+
+// fork returns a copy of p for a forked datastore. Its source is seeded from
+// p so the forks do not share a source but remain reproducible.
+func (p *randomPolicy) fork() ConsistencyPolicy {
+	return &randomPolicy{
+		probability: p.probability,
+		rand:        rand.New(rand.NewSource(p.rand.Int63())),
+	}
+}
+
+// forkPolicy returns the consistency policy of a fork of a datastore using
+// policy. Policies other than the random policy are shared.
+func forkPolicy(policy ConsistencyPolicy) ConsistencyPolicy {
+	if p, ok := policy.(*randomPolicy); ok {
+		return p.fork()
+	}
+	return policy
+}
+
+// RandomConsistencyPolicy returns a ConsistencyPolicy that applies each
+// pending job with the specified probability, similar to the dev_appserver.py
+// PseudoRandomHRConsistencyPolicy. A probability of 0 never applies jobs
+// until ApplyPending is called and 1 is strongly consistent. The same seed
+// will always produce the same sequence of applied jobs.
+func RandomConsistencyPolicy(probability float64,
+	seed int64) ConsistencyPolicy {
+	return RandomConsistencyPolicySource(probability, rand.NewSource(seed))
+}
+
+// RandomConsistencyPolicySource is RandomConsistencyPolicy using source for
+// randomness. A nil source uses the Options.Rand of the datastore the policy
+// is given to, so a single seeded source drives everything random in a test.
+func RandomConsistencyPolicySource(probability float64,
+	source rand.Source) ConsistencyPolicy {
+	p := &randomPolicy{
+		probability: probability,
+	}
+	if source != nil {
+		p.rand = rand.New(source)
+	}
+	return p
+}
+
+// withSource returns policy with a random policy that has no source of its
+// own replaced by one using source.
+func withSource(policy ConsistencyPolicy,
+	source rand.Source) ConsistencyPolicy {
+	if p, ok := policy.(*randomPolicy); ok && p.rand == nil {
+		return &randomPolicy{
+			probability: p.probability,
+			rand:        rand.New(source),
+		}
+	}
+	return policy
+}
+
+// mutation describes a single entity write. A nil entity is a delete.
+type mutation struct {
+	key    datastore.Key
+	entity propertyList
+}
+
+// job is a set of mutations to a single entity group that are applied
+// atomically.
+type job struct {
+	root      datastore.Key
+	mutations []mutation
+}
+
+// rootKey returns the entity group root of key.
+func rootKey(key datastore.Key) datastore.Key {
+	for parent := key.Parent(); parent != nil; parent = parent.Parent() {
+		key = parent
+	}
+	return key
+}
+
+// write commits mutations. They are persisted if the datastore is durable,
+// recorded in the change log and applied immediately if the datastore is
+// strongly consistent, otherwise they are queued as one job per entity group.
+// Subscribers are notified once ds.mu is released by unlock. transactionID is
+// zero outside transactions.
+func (ds *Datastore) write(mutations []mutation, transactionID int64) error {
+	if err := ds.persist(mutations); err != nil {
+		return err
+	}
+	ds.record(mutations, transactionID)
+
+	if ds.consistencyPolicy == nil {
+		for _, m := range mutations {
+			ds.apply(m)
+		}
+		return nil
+	}
+
+	jobs := []*job{}
+	for _, m := range mutations {
+		root := rootKey(m.key)
+
+		var j *job
+		for _, existing := range jobs {
+			if existing.root.Equal(root) {
+				j = existing
+				break
+			}
+		}
+		if j == nil {
+			j = &job{
+				root: root,
+			}
+			jobs = append(jobs, j)
+		}
+		j.mutations = append(j.mutations, m)
+	}
+	ds.pendingJobs = append(ds.pendingJobs, jobs...)
+	return nil
+}
+
+func (ds *Datastore) apply(m mutation) {
+	if m.entity == nil {
+		ds.del(m.key)
+	} else {
+		ds.put(m.key, m.entity)
+	}
+}
+
+// applyJobs applies each pending job that shouldApply returns true for and
+// keeps the rest pending. Jobs within the same entity group are always applied
+// in order.
+func (ds *Datastore) applyJobs(shouldApply func(*job) bool) {
+	pendingJobs := []*job{}
+	blockedRoots := []datastore.Key{}
+
+	for _, j := range ds.pendingJobs {
+		blocked := false
+		for _, root := range blockedRoots {
+			if root.Equal(j.root) {
+				blocked = true
+				break
+			}
+		}
+
+		if blocked || !shouldApply(j) {
+			pendingJobs = append(pendingJobs, j)
+			blockedRoots = append(blockedRoots, j.root)
+			continue
+		}
+
+		for _, m := range j.mutations {
+			ds.apply(m)
+		}
+	}
+	ds.pendingJobs = pendingJobs
+}
+
+// applyGroup applies all pending jobs in the entity group of key.
+func (ds *Datastore) applyGroup(key datastore.Key) {
+	if len(ds.pendingJobs) == 0 {
+		return
+	}
+
+	root := rootKey(key)
+	ds.applyJobs(func(j *job) bool {
+		return j.root.Equal(root)
+	})
+}
+
+// applyPolicy applies the pending jobs the consistency policy chooses.
+func (ds *Datastore) applyPolicy() {
+	if len(ds.pendingJobs) == 0 {
+		return
+	}
+
+	ds.applyJobs(func(j *job) bool {
+		return ds.consistencyPolicy.Apply(j.root)
+	})
+}
+
+// ApplyPending applies all pending writes so that they become visible to
+// global queries. It has no effect on a strongly consistent datastore.
+func (ds *Datastore) ApplyPending() {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	ds.applyJobs(func(*job) bool {
+		return true
+	})
+}
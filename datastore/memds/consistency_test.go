@@ -0,0 +1,128 @@
+package memds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/appengine/datastore"
+	"github.com/qedus/appengine/datastore/memds"
+)
+
+func countQuery(t *testing.T, ds datastore.Datastore, q datastore.Query) int {
+	q.KeysOnly = true
+	iter, err := ds.Run(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := 0
+	for {
+		key, err := iter.Next(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key == nil {
+			return count
+		}
+		count++
+	}
+}
+
+func TestEventualConsistency(t *testing.T) {
+
+	ds := memds.NewWithOptions(memds.Options{
+		ConsistencyPolicy: memds.RandomConsistencyPolicy(0, 1),
+	})
+
+	type testEntity struct {
+		Value int64
+	}
+
+	parentKey := datastore.NewKey("").IntID("Parent", 1)
+	keys := []datastore.Key{
+		parentKey.IntID("Test", 1),
+		datastore.NewKey("").IntID("Test", 2),
+	}
+	if _, err := ds.Put(keys, []testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Global queries should not see any writes yet.
+	if count := countQuery(t, ds, datastore.Query{
+		Kind: "Test",
+	}); count != 0 {
+		t.Fatal("expected no entities got", count)
+	}
+
+	// Ancestor queries are strongly consistent.
+	if count := countQuery(t, ds, datastore.Query{
+		Kind:     "Test",
+		Ancestor: parentKey,
+	}); count != 1 {
+		t.Fatal("expected 1 entity got", count)
+	}
+
+	// Applying the parent entity group makes it visible to global queries.
+	if count := countQuery(t, ds, datastore.Query{
+		Kind: "Test",
+	}); count != 1 {
+		t.Fatal("expected 1 entity got", count)
+	}
+
+	// Gets are strongly consistent.
+	entities := make([]testEntity, 2)
+	if err := ds.Get(keys, entities); err != nil {
+		t.Fatal(err)
+	}
+	if entities[1].Value != 2 {
+		t.Fatal("incorrect entity", entities[1])
+	}
+
+	if err := ds.Delete(keys); err != nil {
+		t.Fatal(err)
+	}
+	if count := countQuery(t, ds, datastore.Query{
+		Kind: "Test",
+	}); count != 2 {
+		t.Fatal("expected 2 entities got", count)
+	}
+
+	ds.ApplyPending()
+	if count := countQuery(t, ds, datastore.Query{
+		Kind: "Test",
+	}); count != 0 {
+		t.Fatal("expected no entities got", count)
+	}
+}
+
+func TestRandomConsistencyPolicy(t *testing.T) {
+
+	type testEntity struct {
+		Value int64
+	}
+
+	// The same seed should always apply the same writes.
+	run := func() int {
+		ds := memds.NewWithOptions(memds.Options{
+			ConsistencyPolicy: memds.RandomConsistencyPolicy(0.5, 42),
+		})
+
+		for i := int64(1); i <= 100; i++ {
+			key := datastore.NewKey("").IntID("Test", i)
+			if _, err := ds.Put([]datastore.Key{key},
+				[]testEntity{{i}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return countQuery(t, ds, datastore.Query{
+			Kind: "Test",
+		})
+	}
+
+	count := run()
+	if count == 0 || count == 100 {
+		t.Fatal("expected some writes to be applied got", count)
+	}
+	if rerunCount := run(); rerunCount != count {
+		t.Fatal("expected", count, "got", rerunCount)
+	}
+}
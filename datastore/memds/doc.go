@@ -3,6 +3,166 @@ Package memds is a pure memory implementation of datastore.Datastore in
 github.com/qedus/appengine/datatastore. It allows for extremely fast unit
 testing of App Engine datastore functionality compared to dev_appserver.py.
 
+Consistency
+
+By default memds is strongly consistent. The eventual consistency of global
+queries in the High Replication datastore can be simulated by creating the
+datastore with NewWithOptions and a ConsistencyPolicy:
+
+	ds := memds.NewWithOptions(memds.Options{
+		ConsistencyPolicy: memds.RandomConsistencyPolicy(0.5, seed),
+	})
+
+ApplyPending can then be used to make all outstanding writes visible.
+
+IDs
+
+Incomplete keys and AllocateKeys are given IDs from a separate sequence for
+each kind and parent. Production gives incomplete keys large scattered IDs
+instead, which can be mimicked in order to catch code that assumes IDs are
+small or sequential:
+
+	ds := memds.NewWithOptions(memds.Options{
+		ScatteredIDs: true,
+		Rand:         rand.NewSource(seed),
+	})
+
+The scattered IDs depend only on Options.Rand, which is seeded with zero if it
+is not set, so the same IDs are allocated every time a test runs.
+
+Time and randomness
+
+Everything in memds that depends on time or randomness can be controlled so
+test runs are reproducible. A ManualClock set as Options.Clock is used for
+transaction timeouts and statistics timestamps, so an expiring transaction
+can be tested by advancing the clock rather than sleeping. A random
+consistency policy given a nil source uses Options.Rand, so a single seed
+drives both scattered IDs and eventual consistency:
+
+	clock := memds.NewManualClock(start)
+	ds := memds.NewWithOptions(memds.Options{
+		ScatteredIDs:      true,
+		Rand:              rand.NewSource(seed),
+		ConsistencyPolicy: memds.RandomConsistencyPolicySource(0.5, nil),
+		Clock:             clock,
+	})
+
+Like production, transactions expire after sixty seconds, after which their
+operations and commit fail with ErrTransactionExpired.
+
+Indexes
+
+Production fails queries that need a composite index that has not been
+declared. memds will do the same if it is given the composite indexes from an
+index.yaml file:
+
+	indexes, err := memds.ReadIndexFile("index.yaml")
+	if err != nil {
+		...
+	}
+	ds := memds.NewWithOptions(memds.Options{
+		Indexes: indexes,
+	})
+
+Like dev_appserver.py, every query run against memds is recorded so the
+minimal index.yaml needed by a test suite can be written with WriteIndexYAML.
+MissingIndexes reports the indexes that a committed index.yaml lacks.
+
+Metadata
+
+Queries on the metadata kinds datastore.NamespaceKind, datastore.KindKind and
+datastore.PropertyKind describe the stored entities like they do in
+production, so datastore.Namespaces, datastore.Kinds and datastore.Properties
+work with memds.
+
+Forking
+
+Fork returns an independent copy of a datastore that shares its entities
+copy-on-write, so an expensive dataset can be seeded once and forked cheaply
+for each test:
+
+	for _, test := range tests {
+		ds := seeded.Fork()
+		...
+	}
+
+Reset returns a datastore to the state it was created in.
+
+Inspection
+
+Len, Has, Keys and Dump read the committed entities directly so tests can
+assert on the contents of the datastore without running queries. They include
+writes that are still pending and never change what queries return.
+
+Changes
+
+A datastore created with Options.RecordChanges records every write committed
+by Put, Delete and RunInTransaction with the entity before and after the
+write and the ID of its transaction, so a test can assert exactly which
+writes happened:
+
+	ds := memds.NewWithOptions(memds.Options{
+		RecordChanges: true,
+	})
+	...
+	ds.ClearChanges()
+	updateOrder(ds, key)
+	for _, c := range ds.Changes() {
+		...
+	}
+
+Subscribe calls a function with each change once it has been committed, which
+is useful for debugging. WatchKey, WatchAncestor and WatchKind do the same
+for a single entity, an entity group subtree or a kind, so reactive caches
+and denormalisers can be tested locally:
+
+	cancel := ds.WatchKind("", "Order", func(c memds.Change) {
+		...
+	})
+	defer cancel()
+
+Changes are only delivered for committed writes and only once every write in
+the same Put, Delete or transaction has been committed.
+
+Statistics
+
+RecomputeStats stores __Stat_Kind__ and __Stat_Total__ entities with the same
+properties as production so code that reads datastore statistics can be
+tested. They are written like any other entities so they are persisted by
+durable datastores, included in snapshots and reported to subscribers.
+
+Snapshots
+
+The contents of a datastore can be written to a file with Save and restored
+with Load in order to quickly start tests or local development servers from a
+realistic dataset. The snapshot format stores property values rather than Go
+struct values so snapshots remain loadable after struct changes. As in
+production, loading an entity into a struct that lacks some of its properties
+or has fields of a different type returns a *datastore.ErrFieldMismatch after
+loading the remaining fields.
+
+Persistence
+
+Open returns a datastore that is persisted to a file so it can replace
+dev_appserver.py for local manual testing:
+
+	ds, err := memds.Open("datastore.json", memds.Options{})
+	if err != nil {
+		...
+	}
+	defer ds.Close()
+
+Every committed write is appended to the file and synced before it is
+applied. A write that a crash interrupted, such as a transaction part way
+through its commit, is discarded when the file is next opened. Compact
+rewrites the file as a snapshot. It happens automatically on Open and Close,
+and when the writes appended since the last compaction are larger than both
+the snapshot and a megabyte.
+
+Like every memds datastore, a durable datastore is safe for concurrent use, so
+it can serve the requests of a local HTTP server that each run in their own
+goroutine.
+
 Status
 
 memds is currently a proof of concept and at present is a low fidelity
@@ -0,0 +1,345 @@
+package memds
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/qedus/appengine/datastore"
+)
+
+// errClosed is returned by writes to a datastore after Close.
+var errClosed = errors.New("memds: datastore is closed")
+
+// minCompactSize is the number of bytes of records a file must have before it
+// is compacted automatically so small files are not rewritten constantly.
+const minCompactSize = 1 << 20
+
+// durableLog persists a datastore created with Open to a file. The file holds
+// a snapshot in the format written by Save followed by a record for each
+// committed write, one JSON object per line. Each record is written and
+// synced before its write is applied so a crash can only lose writes that
+// were never committed.
+type durableLog struct {
+	path string
+	file *os.File
+
+	// snapshotSize is the size of the snapshot written by the last
+	// compaction and recordsSize the bytes of records written since. The
+	// file is compacted once the records are larger than the snapshot so it
+	// is never more than about twice the size of its contents.
+	snapshotSize int64
+	recordsSize  int64
+
+	// draws is the number of values taken by the scattered IDs as it was
+	// last written so it is only logged when it changes.
+	draws int64
+
+	// err is the first error writing the file. Every later write fails with
+	// it so the file can never be missing a write that was committed.
+	err error
+}
+
+// logRecord is a committed write and the sequences and scattered ID draws it
+// changed.
+type logRecord struct {
+	Sequences []snapshotSequence `json:"sequences,omitempty"`
+	Draws     int64              `json:"draws,omitempty"`
+	Mutations []logMutation      `json:"mutations,omitempty"`
+}
+
+type logMutation struct {
+	Key        *snapshotKey       `json:"key"`
+	Properties []snapshotProperty `json:"properties,omitempty"`
+	Delete     bool               `json:"delete,omitempty"`
+}
+
+// Open returns a datastore configured with opts that persists its entities
+// and ID allocations to the file at path, so it can be used in place of
+// dev_appserver.py for local development. The contents of the file are
+// restored if it exists and it is created if it does not. Queries behave
+// exactly as they do for a datastore created with NewWithOptions.
+//
+// A write that was interrupted by a crash, including the commit of a
+// transaction, is discarded when the file is next opened. Writes that were
+// still pending because of the consistency policy are applied. Forks of the
+// datastore are not persisted.
+func Open(path string, opts Options) (*Datastore, error) {
+	ds := NewWithOptions(opts)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := ds.recover(data); err != nil {
+		return nil, err
+	}
+
+	ds.log = &durableLog{
+		path: path,
+	}
+	if err := ds.compact(); err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+// recover restores the datastore from the contents of a file written by a
+// durable datastore.
+func (ds *Datastore) recover(data []byte) error {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	s := snapshot{}
+	if err := dec.Decode(&s); err != nil {
+		return err
+	}
+	if err := ds.restore(s); err != nil {
+		return err
+	}
+
+	for {
+		offset := dec.InputOffset()
+		r := logRecord{}
+		err := dec.Decode(&r)
+		if err == io.EOF {
+			return nil
+		} else if err == nil {
+			if err := ds.replay(r); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Each record is written with its newline in a single write, so a
+		// record that a crash interrupted is at the end of the file without
+		// a newline. It was never committed so it is discarded. Anything
+		// else is corruption.
+		rest := bytes.TrimLeft(data[offset:], " \t\r\n")
+		if bytes.IndexByte(rest, '\n') >= 0 {
+			return fmt.Errorf("memds: corrupt log record at offset %d: %v",
+				offset, err)
+		}
+		return nil
+	}
+}
+
+// replay applies a logged write.
+func (ds *Datastore) replay(r logRecord) error {
+	for _, ss := range r.Sequences {
+		logged, err := decodeSequence(ss)
+		if err != nil {
+			return err
+		}
+
+		base := logged.parent
+		if base == nil {
+			base = datastore.NewKey(logged.namespace)
+		}
+		seq := ds.allocator.sequence(base.IncompleteID(logged.kind))
+		if logged.last > seq.last {
+			ds.allocator.setLast(seq, logged.last)
+		}
+	}
+
+	ds.allocator.counter.skipTo(r.Draws)
+
+	for _, lm := range r.Mutations {
+		key, err := decodeKey(lm.Key)
+		if err != nil {
+			return err
+		}
+		if lm.Delete {
+			ds.apply(mutation{
+				key: key,
+			})
+			continue
+		}
+
+		pl, err := decodeProperties(lm.Properties)
+		if err != nil {
+			return err
+		}
+		ds.apply(mutation{
+			key:    key,
+			entity: pl,
+		})
+	}
+	return nil
+}
+
+// persist writes mutations and any sequences that have changed since the last
+// write to the file of a durable datastore. The file is compacted first if it
+// has grown too large. persist does nothing for other datastores.
+func (ds *Datastore) persist(mutations []mutation) error {
+	l := ds.log
+	if l == nil {
+		return nil
+	} else if l.err != nil {
+		return l.err
+	}
+
+	// The mutations have not been applied yet so they are not in the
+	// snapshot and are logged after it.
+	if l.recordsSize >= minCompactSize && l.recordsSize > l.snapshotSize {
+		if err := ds.compact(); err != nil {
+			return err
+		}
+	}
+
+	r := logRecord{}
+	for _, seq := range ds.allocator.dirty {
+		r.Sequences = append(r.Sequences, encodeSequence(seq))
+	}
+	if draws := ds.allocator.draws(); draws != l.draws {
+		r.Draws = draws
+	}
+	for _, m := range mutations {
+		lm := logMutation{
+			Key:    encodeKey(m.key),
+			Delete: m.entity == nil,
+		}
+		if m.entity != nil {
+			sps, err := encodeProperties(m.entity)
+			if err != nil {
+				return err
+			}
+			lm.Properties = sps
+		}
+		r.Mutations = append(r.Mutations, lm)
+	}
+	if len(r.Sequences) == 0 && r.Draws == 0 && len(r.Mutations) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		l.err = err
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		l.err = err
+		return err
+	}
+	l.recordsSize += int64(len(data) + 1)
+	l.draws = ds.allocator.draws()
+	ds.allocator.takeDirty()
+	return nil
+}
+
+// Compact rewrites the file of a durable datastore as a snapshot of its
+// current contents so it no longer holds a record of every write. The file is
+// replaced atomically so a crash during compaction leaves the previous file.
+// Compact does nothing for datastores not created with Open.
+func (ds *Datastore) Compact() error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return ds.compact()
+}
+
+func (ds *Datastore) compact() error {
+	l := ds.log
+	if l == nil {
+		return nil
+	} else if l.err != nil {
+		return l.err
+	}
+
+	if err := ds.rewrite(); err != nil {
+		l.err = err
+		return err
+	}
+	return nil
+}
+
+// rewrite replaces the file with a snapshot of the datastore.
+func (ds *Datastore) rewrite() error {
+	l := ds.log
+
+	// Pending writes have already been logged so they are included without
+	// being applied.
+	s, err := ds.snapshot(ds.committed())
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(l.path),
+		filepath.Base(l.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if err := writeSnapshot(tmp, s); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), l.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file = file
+	l.snapshotSize = info.Size()
+	l.recordsSize = 0
+
+	// The snapshot holds every sequence and the draws.
+	l.draws = ds.allocator.draws()
+	ds.allocator.takeDirty()
+	return nil
+}
+
+// Close compacts and closes the file of a durable datastore. Writes made
+// after Close fail. Close does nothing for datastores not created with Open.
+func (ds *Datastore) Close() error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	l := ds.log
+	if l == nil {
+		return nil
+	} else if l.err == errClosed {
+		return nil
+	}
+
+	err := ds.compact()
+	if l.file != nil {
+		if closeErr := l.file.Close(); err == nil {
+			err = closeErr
+		}
+		l.file = nil
+	}
+	l.err = errClosed
+	return err
+}
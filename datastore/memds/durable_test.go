@@ -0,0 +1,373 @@
+package memds_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/qedus/appengine/datastore"
+	"github.com/qedus/appengine/datastore/memds"
+)
+
+type durableEntity struct {
+	Value int64
+	Tags  []string
+}
+
+func tempPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "memds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "datastore.json"), func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func open(t *testing.T, path string) *memds.Datastore {
+	ds, err := memds.Open(path, memds.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ds
+}
+
+func TestOpen(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	ds := open(t, path)
+	root := datastore.NewKey("")
+	keys, err := ds.Put([]datastore.Key{
+		root.IncompleteID("Test"),
+		root.IncompleteID("Test"),
+	}, []durableEntity{{1, []string{"a", "b"}}, {2, nil}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.RunInTransaction(func(tx datastore.Datastore) error {
+		if err := tx.Delete(keys[:1]); err != nil {
+			return err
+		}
+		_, err := tx.Put([]datastore.Key{root.StringID("Test", "a")},
+			[]durableEntity{{3, nil}})
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.AllocateKeys(root.IncompleteID("Test"), 10); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen without closing as if the process had been killed.
+	reopened := open(t, path)
+	defer reopened.Close()
+
+	if reopened.Has(keys[0]) || !reopened.Has(keys[1]) ||
+		reopened.Len() != 2 {
+		t.Fatal("unexpected entities", reopened.Keys("", ""))
+	}
+
+	iter, err := reopened.Run(datastore.Query{
+		Kind: "Test",
+		Filters: []datastore.Filter{
+			{"Value", datastore.GreaterThanOp, int64(1)},
+		},
+		Orders: []datastore.Order{{"Value", datastore.DescDir}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entity := &durableEntity{}
+	key, err := iter.Next(entity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Equal(root.StringID("Test", "a")) || entity.Value != 3 {
+		t.Fatal("unexpected entity", key, entity)
+	}
+
+	// Allocated IDs are never reused.
+	allocated, err := reopened.AllocateKeys(root.IncompleteID("Test"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := allocated[0].ID(); id != int64(13) {
+		t.Fatal("expected ID 13 got", id)
+	}
+}
+
+func TestOpenTornWrite(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	ds := open(t, path)
+	key := datastore.NewKey("").IntID("Test", 1)
+	if _, err := ds.Put([]datastore.Key{key},
+		[]durableEntity{{1, nil}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash part way through writing a transaction commit.
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteString(`{"mutations":[{"key":{"path":` +
+		`[{"kind":"Test","intID":2}]},"properties":[{"name"`); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	reopened := open(t, path)
+	if !reopened.Has(key) || reopened.Len() != 1 {
+		t.Fatal("unexpected entities", reopened.Keys("", ""))
+	}
+
+	// The torn write is removed so later writes are recovered.
+	other := datastore.NewKey("").IntID("Test", 3)
+	if _, err := reopened.Put([]datastore.Key{other},
+		[]durableEntity{{3, nil}}); err != nil {
+		t.Fatal(err)
+	}
+	if !open(t, path).Has(other) {
+		t.Fatal("expected write after recovery to be persisted")
+	}
+}
+
+func TestOpenCorrupt(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	open(t, path)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString("{\"mutations\":\n{}\n")
+	file.Close()
+
+	if _, err := memds.Open(path, memds.Options{}); err == nil {
+		t.Fatal("expected corrupt log error")
+	}
+}
+
+func TestCompact(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	ds := open(t, path)
+	key := datastore.NewKey("").IntID("Test", 1)
+	for i := int64(0); i < 100; i++ {
+		if _, err := ds.Put([]datastore.Key{key},
+			[]durableEntity{{i, nil}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ds.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), `"Value"`); n != 1 {
+		t.Fatal("expected one entity after compaction got", n)
+	}
+
+	if err := ds.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.Put([]datastore.Key{key},
+		[]durableEntity{{0, nil}}); err == nil {
+		t.Fatal("expected error writing to a closed datastore")
+	}
+
+	entities := make([]durableEntity, 1)
+	if err := open(t, path).Get([]datastore.Key{key},
+		entities); err != nil {
+		t.Fatal(err)
+	}
+	if entities[0].Value != 99 {
+		t.Fatal("expected value 99 got", entities[0].Value)
+	}
+}
+
+func TestOpenScatteredIDs(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	opts := memds.Options{
+		ScatteredIDs: true,
+	}
+	put := func(ds *memds.Datastore) datastore.Key {
+		keys, err := ds.Put([]datastore.Key{
+			datastore.NewKey("").IncompleteID("Test"),
+		}, []durableEntity{{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ds.Delete(keys); err != nil {
+			t.Fatal(err)
+		}
+		return keys[0]
+	}
+
+	used := map[int64]bool{}
+	for i := 0; i < 3; i++ {
+		ds, err := memds.Open(path, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := put(ds)
+		if used[key.ID().(int64)] {
+			t.Fatal("ID reused after reopening", key)
+		}
+		used[key.ID().(int64)] = true
+
+		// Close once so both the compacted snapshot and the log are
+		// recovered.
+		if i == 1 {
+			if err := ds.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestAutoCompact(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	type blobEntity struct {
+		Data []byte
+	}
+
+	// Write about 3MiB to the same entity so the records soon outgrow the
+	// snapshot.
+	ds := open(t, path)
+	key := datastore.NewKey("").IntID("Test", 1)
+	for i := 0; i < 30; i++ {
+		data := bytes.Repeat([]byte{byte('a' + i%26)}, 100000)
+		if _, err := ds.Put([]datastore.Key{key},
+			[]blobEntity{{data}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 2<<20 {
+		t.Fatal("expected the file to be compacted, size", info.Size())
+	}
+
+	entities := make([]blobEntity, 1)
+	if err := open(t, path).Get([]datastore.Key{key},
+		entities); err != nil {
+		t.Fatal(err)
+	}
+	if len(entities[0].Data) != 100000 || entities[0].Data[0] != 'a'+29%26 {
+		t.Fatal("expected the last write to be recovered")
+	}
+}
+
+func TestOpenNamedTypes(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	type status string
+	type testEntity struct {
+		Status  status
+		Timeout time.Duration
+	}
+
+	key := datastore.NewKey("").IntID("Test", 1)
+	put := testEntity{"active", time.Minute}
+	if _, err := open(t, path).Put([]datastore.Key{key},
+		[]testEntity{put}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]testEntity, 1)
+	if err := open(t, path).Get([]datastore.Key{key}, got); err != nil {
+		t.Fatal(err)
+	}
+	if got[0] != put {
+		t.Fatalf("entities not equal %+v vs %+v", put, got[0])
+	}
+}
+
+func TestOpenConcurrent(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	ds := open(t, path)
+	defer ds.Close()
+
+	// A local server handles each request in its own goroutine.
+	const goroutines, puts = 8, 20
+	use := func(i int) error {
+		parent := datastore.NewKey("").IntID("Parent", int64(i+1))
+		for j := 0; j < puts; j++ {
+			if _, err := ds.Put([]datastore.Key{parent.IncompleteID("Test")},
+				[]durableEntity{{int64(j), nil}}); err != nil {
+				return err
+			}
+			if err := ds.RunInTransaction(func(
+				tx datastore.Datastore) error {
+				_, err := tx.Put([]datastore.Key{parent},
+					[]durableEntity{{int64(j), nil}})
+				return err
+			}); err != nil {
+				return err
+			}
+
+			iter, err := ds.Run(datastore.Query{
+				Kind:     "Test",
+				Ancestor: parent,
+				KeysOnly: true,
+			})
+			if err != nil {
+				return err
+			}
+			n := 0
+			for {
+				key, err := iter.Next(nil)
+				if err != nil {
+					return err
+				} else if key == nil {
+					break
+				}
+				n++
+			}
+			if n != j+1 {
+				return fmt.Errorf("expected %d entities got %d", j+1, n)
+			}
+		}
+		return nil
+	}
+
+	errs := make(chan error)
+	for i := 0; i < goroutines; i++ {
+		go func(i int) {
+			errs <- use(i)
+		}(i)
+	}
+	for i := 0; i < goroutines; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := open(t, path).Len(); n != goroutines*(puts+1) {
+		t.Fatalf("expected %d entities got %d", goroutines*(puts+1), n)
+	}
+}
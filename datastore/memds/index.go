@@ -0,0 +1,433 @@
+package memds
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"github.com/qedus/appengine/datastore"
+	"gopkg.in/yaml.v2"
+)
+
+// IndexProperty is a single property of a composite index.
+type IndexProperty struct {
+	Name string
+	Dir  datastore.OrderDir
+}
+
+// Index describes a composite index in the same way as an entry in an App
+// Engine index.yaml file.
+type Index struct {
+	Kind       string
+	Ancestor   bool
+	Properties []IndexProperty
+}
+
+// String returns the index as an index.yaml list entry.
+func (idx Index) String() string {
+	buf := &bytes.Buffer{}
+	writeIndex(buf, idx)
+	return buf.String()
+}
+
+func writeIndex(w io.Writer, idx Index) error {
+	if _, err := fmt.Fprintf(w, "- kind: %s\n", idx.Kind); err != nil {
+		return err
+	}
+	if idx.Ancestor {
+		if _, err := fmt.Fprint(w, "  ancestor: yes\n"); err != nil {
+			return err
+		}
+	}
+	if len(idx.Properties) == 0 {
+		return nil
+	}
+
+	if _, err := fmt.Fprint(w, "  properties:\n"); err != nil {
+		return err
+	}
+	for _, p := range idx.Properties {
+		if _, err := fmt.Fprintf(w, "  - name: %s\n", p.Name); err != nil {
+			return err
+		}
+		if p.Dir == datastore.DescDir {
+			if _, err := fmt.Fprint(w, "    direction: desc\n"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type yamlIndexes struct {
+	Indexes []struct {
+		Kind       string `yaml:"kind"`
+		Ancestor   bool   `yaml:"ancestor"`
+		Properties []struct {
+			Name      string `yaml:"name"`
+			Direction string `yaml:"direction"`
+		} `yaml:"properties"`
+	} `yaml:"indexes"`
+}
+
+// ReadIndexYAML reads composite index definitions in the App Engine
+// index.yaml format from r.
+func ReadIndexYAML(r io.Reader) ([]Index, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	yi := yamlIndexes{}
+	if err := yaml.Unmarshal(data, &yi); err != nil {
+		return nil, err
+	}
+
+	indexes := make([]Index, len(yi.Indexes))
+	for i, yIdx := range yi.Indexes {
+		if yIdx.Kind == "" {
+			return nil, errors.New("memds: index has no kind")
+		}
+
+		idx := Index{
+			Kind:       yIdx.Kind,
+			Ancestor:   yIdx.Ancestor,
+			Properties: make([]IndexProperty, len(yIdx.Properties)),
+		}
+		for j, yProp := range yIdx.Properties {
+			if yProp.Name == "" {
+				return nil, fmt.Errorf("memds: index %s has unnamed property",
+					yIdx.Kind)
+			}
+
+			var dir datastore.OrderDir
+			switch yProp.Direction {
+			case "", "asc", "ascending":
+				dir = datastore.AscDir
+			case "desc", "descending":
+				dir = datastore.DescDir
+			default:
+				return nil, fmt.Errorf("memds: unknown index direction %s",
+					yProp.Direction)
+			}
+			idx.Properties[j] = IndexProperty{
+				Name: yProp.Name,
+				Dir:  dir,
+			}
+		}
+		indexes[i] = idx
+	}
+	return indexes, nil
+}
+
+// ReadIndexFile reads composite index definitions from an App Engine
+// index.yaml file.
+func ReadIndexFile(filename string) ([]Index, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ReadIndexYAML(bytes.NewReader(data))
+}
+
+type needIndexError struct {
+	index Index
+}
+
+func (nie *needIndexError) Error() string {
+	return "memds: no matching index found. recommended index is:\n" +
+		nie.index.String()
+}
+
+func isInequality(op datastore.FilterOp) bool {
+	return op != datastore.EqualOp
+}
+
+// indexRequirement is the composite index a query needs.
+type indexRequirement struct {
+	index Index
+
+	// equalities is the number of leading index properties that are equality
+	// filtered and can therefore be in any order.
+	equalities int
+
+	// needed is false if the built in indexes can satisfy the query.
+	needed bool
+}
+
+// satisfiedBy returns true if idx can be used to run the query.
+func (req indexRequirement) satisfiedBy(idx Index) bool {
+	if idx.Kind != req.index.Kind || idx.Ancestor != req.index.Ancestor {
+		return false
+	}
+	if len(idx.Properties) != len(req.index.Properties) {
+		return false
+	}
+
+	equalities := map[string]bool{}
+	for _, p := range req.index.Properties[:req.equalities] {
+		equalities[p.Name] = true
+	}
+	for _, p := range idx.Properties[:req.equalities] {
+		if !equalities[p.Name] {
+			return false
+		}
+	}
+
+	for i := req.equalities; i < len(idx.Properties); i++ {
+		if idx.Properties[i] != req.index.Properties[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// compositeIndex returns the composite index requirement of q. The rules
+// follow those used by dev_appserver.py to generate index.yaml.
+func compositeIndex(q datastore.Query) (indexRequirement, error) {
+
+	equalities := map[string]bool{}
+	inequality := ""
+	for _, f := range q.Filters {
+		if !isInequality(f.Op) {
+			equalities[f.Name] = true
+			continue
+		}
+
+		if inequality == "" {
+			inequality = f.Name
+		} else if inequality != f.Name {
+			return indexRequirement{}, errors.New(
+				"memds: inequality filters on multiple properties")
+		}
+	}
+
+	// Orders on equality filtered properties have no effect and nothing can
+	// be ordered after the unique key.
+	orders := []datastore.Order{}
+	for _, o := range q.Orders {
+		if equalities[o.Name] {
+			continue
+		}
+		orders = append(orders, o)
+		if o.Name == datastore.KeyName {
+			break
+		}
+	}
+
+	if inequality != "" && len(orders) > 0 && orders[0].Name != inequality {
+		return indexRequirement{}, fmt.Errorf(
+			"memds: first sort property must be the same as the property "+
+				"to which the inequality filter is applied %s", inequality)
+	}
+
+	// Every index is implicitly ordered by ascending key last.
+	if n := len(orders); n > 0 && orders[n-1].Name == datastore.KeyName &&
+		orders[n-1].Dir == datastore.AscDir {
+		orders = orders[:n-1]
+	}
+
+	postfix := []IndexProperty{}
+	for _, o := range orders {
+		postfix = append(postfix, IndexProperty{
+			Name: o.Name,
+			Dir:  o.Dir,
+		})
+	}
+	if inequality != "" && len(orders) == 0 &&
+		inequality != datastore.KeyName {
+		postfix = append(postfix, IndexProperty{
+			Name: inequality,
+			Dir:  datastore.AscDir,
+		})
+	}
+
+	prefix := []string{}
+	for name := range equalities {
+		prefix = append(prefix, name)
+	}
+	sort.Strings(prefix)
+
+	req := indexRequirement{
+		index: Index{
+			Kind:     q.Kind,
+			Ancestor: q.Ancestor != nil,
+		},
+		equalities: len(prefix),
+	}
+	for _, name := range prefix {
+		req.index.Properties = append(req.index.Properties, IndexProperty{
+			Name: name,
+		})
+	}
+	req.index.Properties = append(req.index.Properties, postfix...)
+
+	switch {
+	case q.Kind == "":
+		// Kindless queries can only filter on ancestors and keys which the
+		// built in indexes support.
+	case len(postfix) == 0 && !equalities[datastore.KeyName]:
+		// Equality only queries can be satisfied by merge joining the built
+		// in single property indexes.
+	case !req.index.Ancestor && len(req.index.Properties) <= 1:
+		// A single property can be satisfied by the built in indexes except
+		// for descending keys.
+		req.needed = len(postfix) == 1 &&
+			postfix[0].Name == datastore.KeyName &&
+			postfix[0].Dir == datastore.DescDir
+	default:
+		req.needed = true
+	}
+	return req, nil
+}
+
+// indexLog records the composite indexes needed by queries. It is shared by a
+// datastore and its forks, which can be queried from different goroutines.
+type indexLog struct {
+	mu           sync.Mutex
+	requirements map[string]indexRequirement
+}
+
+func newIndexLog() *indexLog {
+	return &indexLog{
+		requirements: map[string]indexRequirement{},
+	}
+}
+
+func (l *indexLog) add(req indexRequirement) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.requirements[req.index.String()] = req
+}
+
+// all returns every recorded requirement in no particular order.
+func (l *indexLog) all() []indexRequirement {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	reqs := make([]indexRequirement, 0, len(l.requirements))
+	for _, req := range l.requirements {
+		reqs = append(reqs, req)
+	}
+	return reqs
+}
+
+// checkIndex records the composite index q requires and returns an error if
+// the index has not been declared in the datastore options.
+func (ds *Datastore) checkIndex(q datastore.Query) error {
+	req, err := compositeIndex(q)
+	if err != nil {
+		if ds.indexes == nil {
+			// Only enforce valid queries when enforcing indexes.
+			return nil
+		}
+		return err
+	}
+	if !req.needed {
+		return nil
+	}
+
+	ds.requiredIndexes.add(req)
+
+	if ds.indexes == nil {
+		return nil
+	}
+	for _, idx := range ds.indexes {
+		if req.satisfiedBy(idx) {
+			return nil
+		}
+	}
+	return &needIndexError{
+		index: req.index,
+	}
+}
+
+type indexSorter []Index
+
+func (s indexSorter) Len() int {
+	return len(s)
+}
+
+func (s indexSorter) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s indexSorter) Less(i, j int) bool {
+	l, r := s[i], s[j]
+	if l.Kind != r.Kind {
+		return l.Kind < r.Kind
+	}
+	if l.Ancestor != r.Ancestor {
+		return !l.Ancestor
+	}
+	for k := 0; k < len(l.Properties) && k < len(r.Properties); k++ {
+		lp, rp := l.Properties[k], r.Properties[k]
+		if lp.Name != rp.Name {
+			return lp.Name < rp.Name
+		}
+		if lp.Dir != rp.Dir {
+			return lp.Dir < rp.Dir
+		}
+	}
+	return len(l.Properties) < len(r.Properties)
+}
+
+// RequiredIndexes returns the composite indexes needed by every query that
+// has been run against the datastore. Each index is only returned once and
+// they are always returned in the same order.
+func (ds *Datastore) RequiredIndexes() []Index {
+	reqs := ds.requiredIndexes.all()
+	indexes := make([]Index, 0, len(reqs))
+	for _, req := range reqs {
+		indexes = append(indexes, req.index)
+	}
+	sort.Sort(indexSorter(indexes))
+	return indexes
+}
+
+// MissingIndexes returns the indexes from RequiredIndexes that are not
+// satisfied by the declared indexes. It can be used to fail tests when a new
+// query needs an index that has not yet been added to index.yaml.
+func (ds *Datastore) MissingIndexes(declared []Index) []Index {
+	indexes := []Index{}
+	for _, req := range ds.requiredIndexes.all() {
+		satisfied := false
+		for _, idx := range declared {
+			if req.satisfiedBy(idx) {
+				satisfied = true
+				break
+			}
+		}
+		if !satisfied {
+			indexes = append(indexes, req.index)
+		}
+	}
+	sort.Sort(indexSorter(indexes))
+	return indexes
+}
+
+// WriteIndexYAML writes the index.yaml file needed by every query that has
+// been run against the datastore. The output is stable so it can be compared
+// against a committed index.yaml file.
+func (ds *Datastore) WriteIndexYAML(w io.Writer) error {
+	return WriteIndexes(w, ds.RequiredIndexes())
+}
+
+// WriteIndexes writes indexes to w in the App Engine index.yaml format.
+func WriteIndexes(w io.Writer, indexes []Index) error {
+	if _, err := fmt.Fprint(w, "indexes:\n"); err != nil {
+		return err
+	}
+	for _, idx := range indexes {
+		if _, err := fmt.Fprint(w, "\n"); err != nil {
+			return err
+		}
+		if err := writeIndex(w, idx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
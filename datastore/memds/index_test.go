@@ -0,0 +1,247 @@
+package memds_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/qedus/appengine/datastore"
+	"github.com/qedus/appengine/datastore/memds"
+)
+
+const indexYAML = `
+indexes:
+
+- kind: Test
+  properties:
+  - name: A
+  - name: B
+    direction: desc
+
+- kind: Test
+  ancestor: yes
+  properties:
+  - name: A
+`
+
+func TestReadIndexYAML(t *testing.T) {
+	indexes, err := memds.ReadIndexYAML(strings.NewReader(indexYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(indexes) != 2 {
+		t.Fatal("expected 2 indexes got", len(indexes))
+	}
+
+	idx := indexes[0]
+	if idx.Kind != "Test" || idx.Ancestor || len(idx.Properties) != 2 {
+		t.Fatal("incorrect index", idx)
+	}
+	if idx.Properties[1] != (memds.IndexProperty{
+		Name: "B",
+		Dir:  datastore.DescDir,
+	}) {
+		t.Fatal("incorrect index property", idx.Properties[1])
+	}
+
+	if !indexes[1].Ancestor {
+		t.Fatal("expected ancestor index")
+	}
+}
+
+func TestIndexEnforcement(t *testing.T) {
+	indexes, err := memds.ReadIndexYAML(strings.NewReader(indexYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds := memds.NewWithOptions(memds.Options{
+		Indexes: indexes,
+	})
+
+	ancestor := datastore.NewKey("").IntID("Parent", 1)
+
+	tests := []struct {
+		query     datastore.Query
+		needIndex bool
+	}{
+		// Built in indexes.
+		{datastore.Query{Kind: "Test"}, false},
+		{datastore.Query{
+			Kind:     "Test",
+			Ancestor: ancestor,
+		}, false},
+		{datastore.Query{
+			Kind:   "Test",
+			Orders: []datastore.Order{{"C", datastore.DescDir}},
+		}, false},
+		{datastore.Query{
+			Kind: "Test",
+			Filters: []datastore.Filter{
+				{"C", datastore.EqualOp, int64(1)},
+				{"D", datastore.EqualOp, int64(1)},
+			},
+		}, false},
+		{datastore.Query{
+			Kind: "Test",
+			Filters: []datastore.Filter{
+				{"C", datastore.GreaterThanOp, int64(1)},
+				{"C", datastore.LessThanOp, int64(3)},
+			},
+		}, false},
+		{datastore.Query{
+			Kind: "Test",
+			Filters: []datastore.Filter{
+				{"C", datastore.EqualOp, int64(1)},
+			},
+			Orders: []datastore.Order{{"C", datastore.AscDir}},
+		}, false},
+
+		// Declared composite indexes.
+		{datastore.Query{
+			Kind: "Test",
+			Filters: []datastore.Filter{
+				{"A", datastore.EqualOp, int64(1)},
+			},
+			Orders: []datastore.Order{{"B", datastore.DescDir}},
+		}, false},
+		{datastore.Query{
+			Kind:     "Test",
+			Ancestor: ancestor,
+			Filters: []datastore.Filter{
+				{"A", datastore.GreaterThanOp, int64(1)},
+			},
+		}, false},
+
+		// Undeclared composite indexes.
+		{datastore.Query{
+			Kind: "Test",
+			Filters: []datastore.Filter{
+				{"A", datastore.EqualOp, int64(1)},
+			},
+			Orders: []datastore.Order{{"B", datastore.AscDir}},
+		}, true},
+		{datastore.Query{
+			Kind:     "Test",
+			Ancestor: ancestor,
+			Orders:   []datastore.Order{{"C", datastore.AscDir}},
+		}, true},
+		{datastore.Query{
+			Kind:   "Test",
+			Orders: []datastore.Order{{datastore.KeyName, datastore.DescDir}},
+		}, true},
+	}
+
+	for i, test := range tests {
+		_, err := ds.Run(test.query)
+		if test.needIndex {
+			if err == nil || !strings.Contains(err.Error(),
+				"no matching index found") {
+				t.Fatal(i, "expected no index error got", err)
+			}
+		} else if err != nil {
+			t.Fatal(i, err)
+		}
+	}
+
+	// The error should recommend the missing index.
+	_, err = ds.Run(datastore.Query{
+		Kind: "Test",
+		Filters: []datastore.Filter{
+			{"A", datastore.EqualOp, int64(1)},
+		},
+		Orders: []datastore.Order{{"B", datastore.AscDir}},
+	})
+	expected := "- kind: Test\n  properties:\n  - name: A\n  - name: B\n"
+	if err == nil || !strings.HasSuffix(err.Error(), expected) {
+		t.Fatal("incorrect recommended index", err)
+	}
+
+	// Inequality filters must be on a single property.
+	if _, err := ds.Run(datastore.Query{
+		Kind: "Test",
+		Filters: []datastore.Filter{
+			{"A", datastore.GreaterThanOp, int64(1)},
+			{"B", datastore.GreaterThanOp, int64(1)},
+		},
+	}); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestWriteIndexYAML(t *testing.T) {
+	ds := memds.New()
+
+	queries := []datastore.Query{
+		{
+			Kind: "Test",
+			Filters: []datastore.Filter{
+				{"B", datastore.EqualOp, int64(1)},
+				{"A", datastore.EqualOp, int64(1)},
+			},
+			Orders: []datastore.Order{{"C", datastore.DescDir}},
+		},
+		{
+			Kind:     "Other",
+			Ancestor: datastore.NewKey("").IntID("Parent", 1),
+			Orders:   []datastore.Order{{"A", datastore.AscDir}},
+		},
+
+		// The same shape as the first query so should not be written twice.
+		{
+			Kind: "Test",
+			Filters: []datastore.Filter{
+				{"A", datastore.EqualOp, int64(2)},
+				{"B", datastore.EqualOp, int64(2)},
+			},
+			Orders: []datastore.Order{{"C", datastore.DescDir}},
+		},
+
+		// Built in indexes are not written.
+		{
+			Kind:   "Test",
+			Orders: []datastore.Order{{"A", datastore.AscDir}},
+		},
+	}
+	for _, q := range queries {
+		if _, err := ds.Run(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := ds.WriteIndexYAML(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `indexes:
+
+- kind: Other
+  ancestor: yes
+  properties:
+  - name: A
+
+- kind: Test
+  properties:
+  - name: A
+  - name: B
+  - name: C
+    direction: desc
+`
+	if buf.String() != expected {
+		t.Fatalf("incorrect index.yaml\n%s", buf.String())
+	}
+
+	// The written file should be readable and satisfy every query.
+	indexes, err := memds.ReadIndexYAML(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missing := ds.MissingIndexes(indexes); len(missing) != 0 {
+		t.Fatal("expected no missing indexes got", missing)
+	}
+	if missing := ds.MissingIndexes(indexes[1:]); len(missing) != 1 ||
+		missing[0].Kind != "Other" {
+		t.Fatal("expected missing index got", missing)
+	}
+}
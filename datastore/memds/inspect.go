@@ -0,0 +1,99 @@
+package memds
+
+import (
+	"github.com/qedus/appengine/datastore"
+)
+
+// Entity is a stored entity as returned by Dump. Properties are keyed by name
+// and multi-valued properties are a []interface{}.
+type Entity struct {
+	Key        datastore.Key
+	Properties map[string]interface{}
+}
+
+// committed returns every committed entity in key order. Writes that are
+// still pending because of the consistency policy are included but are not
+// applied, so inspecting the datastore never changes what queries return.
+func (ds *Datastore) committed() []keyEntity {
+	if len(ds.pendingJobs) == 0 {
+		return ds.store.all()
+	}
+
+	view := &Datastore{
+		store: newStore(ds.store),
+	}
+	for _, j := range ds.pendingJobs {
+		for _, m := range j.mutations {
+			view.apply(m)
+		}
+	}
+	return view.store.all()
+}
+
+// Len returns the number of committed entities.
+func (ds *Datastore) Len() int {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	return len(ds.committed())
+}
+
+// Has returns true if an entity with key has been committed.
+func (ds *Datastore) Has(key datastore.Key) bool {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	return ds.committedEntity(key) != nil
+}
+
+// Keys returns the keys of the committed entities of kind within namespace in
+// key order. An empty kind returns the keys of every kind.
+func (ds *Datastore) Keys(namespace, kind string) []datastore.Key {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	keys := []datastore.Key{}
+	for _, ke := range ds.committed() {
+		if ke.key.Namespace() != namespace {
+			continue
+		}
+		if kind != "" && ke.key.Kind() != kind {
+			continue
+		}
+		keys = append(keys, ke.key)
+	}
+	return keys
+}
+
+// newEntity returns the Entity for a stored entity.
+func newEntity(key datastore.Key, pl propertyList) Entity {
+	properties := map[string]interface{}{}
+	for _, p := range pl {
+		value := copyValue(p.value)
+		if !p.multiple {
+			properties[p.name] = value
+			continue
+		}
+
+		values, _ := properties[p.name].([]interface{})
+		properties[p.name] = append(values, value)
+	}
+	return Entity{
+		Key:        key,
+		Properties: properties,
+	}
+}
+
+// Dump returns every committed entity in key order.
+func (ds *Datastore) Dump() []Entity {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	committed := ds.committed()
+
+	entities := make([]Entity, len(committed))
+	for i, ke := range committed {
+		entities[i] = newEntity(ke.key, ke.entity)
+	}
+	return entities
+}
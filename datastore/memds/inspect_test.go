@@ -0,0 +1,85 @@
+package memds_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/qedus/appengine/datastore"
+	"github.com/qedus/appengine/datastore/memds"
+)
+
+func TestInspect(t *testing.T) {
+	ds := memds.NewWithOptions(memds.Options{
+		ConsistencyPolicy: memds.RandomConsistencyPolicy(0, 1),
+	})
+
+	type testEntity struct {
+		Name string
+		Tags []string
+	}
+
+	keys := []datastore.Key{
+		datastore.NewKey("").StringID("B", "b"),
+		datastore.NewKey("").StringID("A", "a"),
+		datastore.NewKey("ns").StringID("A", "c"),
+	}
+	if _, err := ds.Put(keys, []testEntity{
+		{"b", nil},
+		{"a", []string{"x", "y"}},
+		{"c", nil},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if ds.Len() != 3 {
+		t.Fatal("expected 3 entities got", ds.Len())
+	}
+	if !ds.Has(keys[0]) {
+		t.Fatal("expected entity", keys[0])
+	}
+	if ds.Has(datastore.NewKey("").StringID("B", "z")) {
+		t.Fatal("unexpected entity")
+	}
+
+	if !reflect.DeepEqual(ds.Keys("", ""),
+		[]datastore.Key{keys[1], keys[0]}) {
+		t.Fatal("incorrect keys", ds.Keys("", ""))
+	}
+	if !reflect.DeepEqual(ds.Keys("ns", "A"), []datastore.Key{keys[2]}) {
+		t.Fatal("incorrect keys", ds.Keys("ns", "A"))
+	}
+
+	dump := ds.Dump()
+	if len(dump) != 3 {
+		t.Fatal("expected 3 entities got", len(dump))
+	}
+	if !dump[0].Key.Equal(keys[1]) || !reflect.DeepEqual(
+		dump[0].Properties, map[string]interface{}{
+			"Name": "a",
+			"Tags": []interface{}{"x", "y"},
+		}) {
+		t.Fatalf("incorrect entity %+v", dump[0])
+	}
+
+	// Inspecting must not apply the pending writes.
+	if count := countQuery(t, ds, datastore.Query{Kind: "A"}); count != 0 {
+		t.Fatal("expected no visible entities got", count)
+	}
+
+	if err := ds.Delete(keys[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if ds.Has(keys[0]) {
+		t.Fatal("expected deleted entity")
+	}
+
+	// Entities without properties still exist.
+	empty := datastore.NewKey("").StringID("Empty", "e")
+	if _, err := ds.Put([]datastore.Key{empty},
+		[]struct{}{{}}); err != nil {
+		t.Fatal(err)
+	}
+	if !ds.Has(empty) {
+		t.Fatal("expected entity", empty)
+	}
+}
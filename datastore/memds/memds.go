@@ -3,13 +3,14 @@ package memds
 import (
 	"errors"
 	"fmt"
+	"math/rand"
 	"reflect"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/qedus/appengine/datastore"
-	ids "github.com/qedus/appengine/internal/datastore"
 )
 
 type notFoundError map[int]bool
@@ -22,9 +23,11 @@ func (nfe notFoundError) NotFound(index int) bool {
 	return nfe[index]
 }
 
+// keyEntity is a stored entity. Entities are stored as their properties so
+// they can be loaded into any struct type like they can in production.
 type keyEntity struct {
 	key    datastore.Key
-	entity interface{}
+	entity propertyList
 }
 
 type keyValue struct {
@@ -32,23 +35,126 @@ type keyValue struct {
 	value interface{}
 }
 
-type ds struct {
-	keyEntities []keyEntity
-	lastIntID   int64
+// Datastore is a datastore.TransactionalDatastore that resides solely in
+// memory. It is safe for concurrent use by multiple goroutines so it can
+// serve a local development server.
+type Datastore struct {
+	// mu guards every field below that is not fixed at creation. It is held
+	// for the whole of each public method except while subscribers and
+	// transaction functions are called.
+	mu sync.Mutex
+
+	store     *store
+	allocator *allocator
+
+	clock              Clock
+	transactionTimeout time.Duration
+
+	recordChanges    bool
+	changes          []change
+	transactions     int64
+	subscribers      []subscriber
+	nextSubscriberID int
+	unnotified       []change
+	notifying        bool
+
+	// log persists the datastore if it was created with Open.
+	log *durableLog
+
+	consistencyPolicy ConsistencyPolicy
+	pendingJobs       []*job
+
+	indexes         []Index
+	requiredIndexes *indexLog
+}
+
+// unlock releases ds.mu and then passes the changes committed while it was
+// held to the subscribers, which can then use the datastore themselves.
+func (ds *Datastore) unlock() {
+	ds.mu.Unlock()
+	ds.notify()
+}
+
+// Options is used to configure a Datastore created with NewWithOptions.
+type Options struct {
+
+	// ConsistencyPolicy determines when writes become visible to global
+	// queries. A nil policy makes the datastore strongly consistent.
+	ConsistencyPolicy ConsistencyPolicy
+
+	// Indexes are the composite indexes available to queries, usually read
+	// from an index.yaml file with ReadIndexFile. Queries that need a
+	// composite index that is not declared will fail like they do in
+	// production. A nil Indexes does not enforce composite indexes.
+	Indexes []Index
+
+	// ScatteredIDs makes Put give incomplete keys large scattered IDs like
+	// production does rather than small sequential ones. AllocateKeys always
+	// uses a sequence for each kind and parent.
+	ScatteredIDs bool
+
+	// Rand is the source of randomness for scattered IDs and for a
+	// RandomConsistencyPolicySource given a nil source, so a single seed
+	// makes a test reproducible. A nil Rand uses a source seeded with zero so
+	// the same IDs are allocated every time a test runs.
+	Rand rand.Source
+
+	// Clock provides the time used for transaction timeouts and statistics
+	// timestamps. A nil Clock uses the system clock.
+	Clock Clock
+
+	// TransactionTimeout is how long a transaction can run before it
+	// expires. Zero uses production's sixty seconds.
+	TransactionTimeout time.Duration
+
+	// RecordChanges records every committed write so it can be read with
+	// Changes. The log grows until ClearChanges is called so it is off by
+	// default. Subscribers are called whether or not changes are recorded.
+	RecordChanges bool
 }
 
+// Datastore is returned as a concrete type so that memds only methods such as
+// ApplyPending are available. It can still be used anywhere a
+// datastore.TransactionalDatastore is expected.
+var _ datastore.TransactionalDatastore = (*Datastore)(nil)
+
 // New creates a new TransationalDatastore that resides solely in memory. It is
 // useful for fast unit testing datastore code compared to using
 // google.golang.org/appengine/aetest.
-func New() datastore.TransactionalDatastore {
-	return &ds{
-		keyEntities: []keyEntity{},
-	}
+func New() *Datastore {
+	return NewWithOptions(Options{})
 }
 
-func (ds *ds) nextIntID() int64 {
-	ds.lastIntID++
-	return ds.lastIntID
+// NewWithOptions creates a new in memory datastore configured with opts.
+func NewWithOptions(opts Options) *Datastore {
+	clock := opts.Clock
+	if clock == nil {
+		clock = systemClock{}
+	}
+	transactionTimeout := opts.TransactionTimeout
+	if transactionTimeout == 0 {
+		transactionTimeout = defaultTransactionTimeout
+	}
+
+	source := opts.Rand
+	if source == nil {
+		source = rand.NewSource(0)
+	}
+
+	return &Datastore{
+		store:     newStore(nil),
+		allocator: newAllocator(opts.ScatteredIDs, 0, opts.Rand),
+
+		clock:              clock,
+		transactionTimeout: transactionTimeout,
+
+		recordChanges: opts.RecordChanges,
+
+		consistencyPolicy: withSource(opts.ConsistencyPolicy, source),
+
+		indexes:         opts.Indexes,
+		requiredIndexes: newIndexLog(),
+	}
 }
 
 func extractStruct(entity interface{}) (reflect.Value, error) {
@@ -67,7 +173,10 @@ func extractStruct(entity interface{}) (reflect.Value, error) {
 	return val, nil
 }
 
-func (ds *ds) Get(keys []datastore.Key, entities interface{}) error {
+func (ds *Datastore) Get(keys []datastore.Key, entities interface{}) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
 	values := reflect.ValueOf(entities)
 
 	if err := verifyKeysValues(keys, values); err != nil {
@@ -75,11 +184,22 @@ func (ds *ds) Get(keys []datastore.Key, entities interface{}) error {
 	}
 
 	nfe := notFoundError{}
+	var mismatch error
 	for i, key := range keys {
 		value := values.Index(i)
+		if value.Kind() == reflect.Struct {
+			// Load []S entities in place. Without this they would be loaded
+			// into a copy and lost, although the Datastore interface allows
+			// []S entities.
+			value = value.Addr()
+		}
 
 		found, err := ds.get(key, value.Interface())
-		if err != nil {
+		if _, ok := err.(*datastore.ErrFieldMismatch); ok {
+			if mismatch == nil {
+				mismatch = err
+			}
+		} else if err != nil {
 			return err
 		}
 		if !found {
@@ -88,35 +208,29 @@ func (ds *ds) Get(keys []datastore.Key, entities interface{}) error {
 	}
 
 	if len(nfe) == 0 {
-		return nil
+		// Like production, entities are still loaded when some of their
+		// properties do not match the struct.
+		return mismatch
 	}
 
 	return nfe
 }
 
-func (ds *ds) get(key datastore.Key, entity interface{}) (bool, error) {
+func (ds *Datastore) get(key datastore.Key, entity interface{}) (bool, error) {
 
 	val, err := extractStruct(entity)
 	if err != nil {
 		return false, err
 	}
 
-	ke := ds.findKeyEntity(key)
-	if ke == nil {
-		return false, nil
-	}
-	val.Set(reflect.ValueOf(ke.entity))
-
-	return true, nil
-}
+	// Gets are strongly consistent so make sure the entity group is up to date.
+	ds.applyGroup(key)
 
-func (ds *ds) findKeyEntity(key datastore.Key) *keyEntity {
-	for _, ke := range ds.keyEntities {
-		if ke.key.Equal(key) {
-			return &ke
-		}
+	ke, exists := ds.store.get(key)
+	if !exists {
+		return false, nil
 	}
-	return nil
+	return true, loadStruct(ke.entity, val)
 }
 
 func verifyKeysValues(keys []datastore.Key, values reflect.Value) error {
@@ -157,42 +271,76 @@ func verifyKeysValues(keys []datastore.Key, values reflect.Value) error {
 	return errors.New("entities not structs or pointers")
 }
 
-func (ds *ds) Put(keys []datastore.Key, entities interface{}) (
+func (ds *Datastore) Put(keys []datastore.Key, entities interface{}) (
 	[]datastore.Key, error) {
+
+	ds.mu.Lock()
+	defer ds.unlock()
+
+	mutations, err := ds.putMutations(keys, entities)
+	if err != nil {
+		return nil, err
+	}
+	if err := ds.write(mutations, 0); err != nil {
+		return nil, err
+	}
+
+	completeKeys := make([]datastore.Key, len(mutations))
+	for i, m := range mutations {
+		completeKeys[i] = m.key
+	}
+	return completeKeys, nil
+}
+
+// putMutations returns the mutations needed to put entities with complete
+// versions of keys.
+func (ds *Datastore) putMutations(keys []datastore.Key,
+	entities interface{}) ([]mutation, error) {
 	values := reflect.ValueOf(entities)
 
 	if err := verifyKeysValues(keys, values); err != nil {
 		return nil, err
 	}
 
-	completeKeys := make([]datastore.Key, len(keys))
+	mutations := make([]mutation, len(keys))
 	for i, key := range keys {
-		val := values.Index(i)
-		completeKey, err := ds.put(key, val.Interface())
+		entity, err := entityPropertyList(values.Index(i).Interface())
 		if err != nil {
 			return nil, err
 		}
-		completeKeys[i] = completeKey
-	}
 
-	return completeKeys, nil
-}
+		completeKey := ds.completeKey(key)
+		if err := ds.validateEntity(completeKey, entity); err != nil {
+			return nil, err
+		}
 
-func (ds *ds) put(key datastore.Key, entity interface{}) (
-	datastore.Key, error) {
+		mutations[i] = mutation{
+			key:    completeKey,
+			entity: entity,
+		}
+	}
+	return mutations, nil
+}
 
-	// If key is incomplete then complete it.
-	if key.Incomplete() {
-		namespace := key.Namespace()
-		kind := key.Kind()
+// completeKey returns key with a newly allocated integer ID if it is
+// incomplete.
+func (ds *Datastore) completeKey(key datastore.Key) datastore.Key {
+	if !key.Incomplete() {
+		return key
+	}
 
-		parent := key.Parent()
-		if parent == nil {
-			key = datastore.NewKey(namespace).IntID(kind, ds.nextIntID())
-		} else {
-			key = parent.IntID(kind, ds.nextIntID())
-		}
+	parent := key.Parent()
+	if parent == nil {
+		parent = datastore.NewKey(key.Namespace())
 	}
+	id := ds.allocator.autoID(key, func(id int64) bool {
+		return ds.committedEntity(parent.IntID(key.Kind(), id)) != nil
+	})
+	return parent.IntID(key.Kind(), id)
+}
+
+// entityPropertyList returns the properties that will be stored for entity.
+func entityPropertyList(entity interface{}) (propertyList, error) {
 
 	val := reflect.ValueOf(entity)
 	switch val.Kind() {
@@ -206,104 +354,95 @@ func (ds *ds) put(key datastore.Key, entity interface{}) (
 	default:
 		return nil, errors.New("memds: entity not struct or struct pointer")
 	}
+	return saveStruct(val), nil
+}
 
-	// Ensure all fields are zeroed if asked to do so by the struct tags.
-	for i := 0; i < val.NumField(); i++ {
-		fieldVal := reflect.Indirect(val.Field(i))
-
-		fieldStruct := val.Type().Field(i)
-		if ids.PropertyName(fieldStruct) == "" {
-			fieldVal.Set(reflect.Zero(fieldVal.Type()))
-		}
-	}
-
-	// Check if we already have an entity for this key.
-	if ke := ds.findKeyEntity(key); ke == nil {
-		// Key doesn't exist so add it.
-		ds.keyEntities = append(ds.keyEntities, keyEntity{
-			key:    key,
-			entity: val.Interface(), // Make sure we capture the value not ptr.
-		})
-	} else {
-		// Key already exists so just update the entity.
-		ke.entity = val.Interface() // Make sure we capture the value not ptr.
-	}
-
-	return key, nil
+func (ds *Datastore) put(key datastore.Key, entity propertyList) {
+	ds.store.put(key, entity)
 }
 
-func (ds *ds) Delete(keys []datastore.Key) error {
+func (ds *Datastore) Delete(keys []datastore.Key) error {
+	ds.mu.Lock()
+	defer ds.unlock()
 
-	for _, key := range keys {
-		if err := ds.del(key); err != nil {
-			return err
-		}
-	}
-	return nil
+	return ds.write(deleteMutations(keys), 0)
 }
 
-func (ds *ds) del(key datastore.Key) error {
-
-	// Find the key entity and delete it from slice of key entities.
-	for i, ke := range ds.keyEntities {
-		if ke.key.Equal(key) {
-			// This slice element delete will leak memory but is simple. See
-			// https://goo.gl/4Eer5r for a solution if this becomes a problem.
-			ds.keyEntities = append(ds.keyEntities[:i], ds.keyEntities[i+1:]...)
-			break
+func deleteMutations(keys []datastore.Key) []mutation {
+	mutations := make([]mutation, len(keys))
+	for i, key := range keys {
+		mutations[i] = mutation{
+			key: key,
 		}
 	}
-	return nil
+	return mutations
 }
 
-// compareValues compares according to App Engine comparators.
-func compareValues(left, right interface{}) int {
+func (ds *Datastore) del(key datastore.Key) {
+	ds.store.del(key)
+}
 
-	// The order in which the App Engine datastore compares types.
-	comp := 0
-	switch left.(type) {
-	case int64:
-		comp = -6
-	case time.Time:
-		comp = -5
+// typeOrder returns the position of the type of value in the order that App
+// Engine sorts property types. Null values come before any other type. Times
+// are indexed as integers and short blobs as strings so they share an order.
+func typeOrder(value interface{}) int {
+	switch value.(type) {
+	case nil:
+		return 0
+	case int64, time.Time:
+		return 1
 	case bool:
-		comp = -4
-	case string:
-		comp = -3
+		return 2
+	case string, []byte:
+		return 3
 	case float64:
-		comp = -2
+		return 4
+	case datastore.GeoPoint:
+		return 5
 	case datastore.Key:
-		comp = -1
+		return 6
 	default:
 		panic("unknown property type")
 	}
+}
 
-	switch right.(type) {
-	case int64:
-		comp = comp + 6
+// indexValue returns value as it is stored in an index. Times are stored as
+// microseconds since the Unix epoch and short blobs as strings.
+func indexValue(value interface{}) interface{} {
+	switch v := value.(type) {
 	case time.Time:
-		comp = comp + 5
-	case bool:
-		comp = comp + 4
-	case string:
-		comp = comp + 3
-	case float64:
-		comp = comp + 2
-	case datastore.Key:
-		comp = comp + 1
-	default:
-		panic("unknown property type")
+		return v.Unix()*1e6 + int64(v.Nanosecond()/1e3)
+	case []byte:
+		return string(v)
+	}
+	return value
+}
+
+func compareFloats(l, r float64) int {
+	if l < r {
+		return -1
+	} else if l > r {
+		return 1
 	}
+	return 0
+}
+
+// compareValues compares according to App Engine comparators.
+func compareValues(left, right interface{}) int {
 
-	if comp < 0 {
+	leftOrder, rightOrder := typeOrder(left), typeOrder(right)
+	if leftOrder < rightOrder {
 		return -1
-	} else if comp > 0 {
+	} else if leftOrder > rightOrder {
 		return 1
 	}
 
-	// We know the left type is the same as the right as comp == 0 so now
-	// compare the values of each type.
+	// We know the left type is the same as the right once they are index
+	// values so now compare the values of each type.
+	left, right = indexValue(left), indexValue(right)
 	switch left.(type) {
+	case nil:
+		return 0
 	case bool:
 		l, r := left.(bool), right.(bool)
 		if !l && r {
@@ -323,114 +462,141 @@ func compareValues(left, right interface{}) int {
 		}
 		return 0
 	case float64:
-		l, r := left.(float64), right.(float64)
-		if l < r {
-			return -1
-		} else if l > r {
-			return 1
+		return compareFloats(left.(float64), right.(float64))
+	case datastore.GeoPoint:
+		l, r := left.(datastore.GeoPoint), right.(datastore.GeoPoint)
+		if comp := compareFloats(l.Lat, r.Lat); comp != 0 {
+			return comp
 		}
-		return 0
+		return compareFloats(l.Lng, r.Lng)
 	case datastore.Key:
 		return compareKeys(left.(datastore.Key), right.(datastore.Key))
-	case time.Time:
-		l, r := left.(time.Time), right.(time.Time)
-		if l.Before(r) {
-			return -1
-		} else if l.After(r) {
-			return 1
-		}
-		return 0
 	default:
 		panic("unknown property type")
 	}
 }
 
-func compareKeys(left, right datastore.Key) int {
-
-	// Keys with more parents come before those with less.
-	leftParentCount := 0
-	for parent := left.Parent(); parent != nil; parent = parent.Parent() {
-		leftParentCount++
+// keyPath returns the elements of key starting with its root.
+func keyPath(key datastore.Key) []datastore.Key {
+	path := []datastore.Key{}
+	for ; key != nil; key = key.Parent() {
+		path = append(path, key)
 	}
-
-	rightParentCount := 0
-	for parent := right.Parent(); parent != nil; parent = parent.Parent() {
-		rightParentCount++
-	}
-
-	if leftParentCount > rightParentCount {
-		return -1
-	} else if leftParentCount < rightParentCount {
-		return 1
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
 	}
+	return path
+}
 
-	// From now on we know both keys have the same number of parents.
-
-	// Order by IDs.
-	leftID := left.ID()
-	rightID := right.ID()
-
-	comp := 0
+// compareKeys compares keys like App Engine does, one path element at a time
+// starting from the root. Each element is ordered by kind and then by ID
+// where integer IDs come before string IDs. A key comes before its
+// descendants.
+func compareKeys(left, right datastore.Key) int {
 
-	// Integer IDs always come before string IDs.
-	switch leftID.(type) {
-	case int64:
-		comp = -2
-	case string:
-		comp = -1
-	default:
-		panic("unknown ID type")
+	if comp := strings.Compare(left.Namespace(), right.Namespace()); comp != 0 {
+		return comp
 	}
 
-	switch rightID.(type) {
-	case int64:
-		comp = comp + 2
-	case string:
-		comp = comp + 1
-	default:
-		panic("unknown ID type")
+	leftPath, rightPath := keyPath(left), keyPath(right)
+	for i := 0; i < len(leftPath) && i < len(rightPath); i++ {
+		if comp := strings.Compare(leftPath[i].Kind(),
+			rightPath[i].Kind()); comp != 0 {
+			return comp
+		}
+
+		if comp := compareIDs(leftPath[i].ID(),
+			rightPath[i].ID()); comp != 0 {
+			return comp
+		}
 	}
 
-	if comp < 0 {
+	switch {
+	case len(leftPath) < len(rightPath):
 		return -1
-	} else if comp > 0 {
+	case len(leftPath) > len(rightPath):
 		return 1
 	}
+	return 0
+}
 
-	// Types are the same so compare by type.
-	switch leftID.(type) {
+func compareIDs(left, right interface{}) int {
+	switch l := left.(type) {
 	case int64:
-		l, r := leftID.(int64), rightID.(int64)
-		if l < r {
+		switch r := right.(type) {
+		case int64:
+			if l < r {
+				return -1
+			} else if l > r {
+				return 1
+			}
+			return 0
+		case string:
+			// Integer IDs always come before string IDs.
 			return -1
-		} else if l > r {
-			return 1
-		}
-
-		// If IDs are identical then lets try comparing parent IDs.
-		if left.Parent() != nil {
-			return compareKeys(left.Parent(), right.Parent())
 		}
-		return 0
 	case string:
-		comp := strings.Compare(leftID.(string), rightID.(string))
-		if comp != 0 {
-			return comp
-		}
-
-		// If IDs are identical then lets try comparing parent IDs.
-		if left.Parent() != nil {
-			return compareKeys(left.Parent(), right.Parent())
+		switch r := right.(type) {
+		case int64:
+			return 1
+		case string:
+			return strings.Compare(l, r)
 		}
-		return 0
-	default:
-		panic("unknown ID type")
 	}
+	panic("unknown ID type")
 }
 
 type keyEntitySorter struct {
 	keyEntities []keyEntity
 	orders      []datastore.Order
+
+	// filters restrict which values of multi-valued properties are sorted.
+	filters []datastore.Filter
+}
+
+// sortValue returns the value of the entity property o sorts by. Multi-valued
+// properties sort ascending by their smallest value and descending by their
+// largest value, only considering values that match any filters on the same
+// property.
+func (s *keyEntitySorter) sortValue(ke keyEntity,
+	o datastore.Order) interface{} {
+	value, _, _ := ke.entity.property(o.Name)
+	values, ok := value.([]interface{})
+	if !ok {
+		return value
+	}
+
+	var sortValue interface{}
+	found := false
+	for _, v := range values {
+		if !matchesInequalities(v, o.Name, s.filters) {
+			continue
+		}
+
+		switch {
+		case !found:
+			sortValue = v
+			found = true
+		case o.Dir == datastore.AscDir && compareValues(v, sortValue) < 0:
+			sortValue = v
+		case o.Dir == datastore.DescDir && compareValues(v, sortValue) > 0:
+			sortValue = v
+		}
+	}
+	return sortValue
+}
+
+// matchesInequalities returns true if value matches every inequality filter
+// on name.
+func matchesInequalities(value interface{}, name string,
+	filters []datastore.Filter) bool {
+	for _, f := range filters {
+		if f.Name == name && f.Op != datastore.EqualOp &&
+			!isComparisonTrue(value, f.Op, normalizeValue(f.Value)) {
+			return false
+		}
+	}
+	return true
 }
 
 func (s *keyEntitySorter) Len() int {
@@ -445,9 +611,6 @@ func (s *keyEntitySorter) Less(l, r int) bool {
 	lke := s.keyEntities[l]
 	rke := s.keyEntities[r]
 
-	leftEntity := reflect.ValueOf(lke.entity)
-	rightEntity := reflect.ValueOf(rke.entity)
-
 	for _, o := range s.orders {
 
 		// Compare entity keys.
@@ -462,78 +625,84 @@ func (s *keyEntitySorter) Less(l, r int) bool {
 		}
 
 		// Compare entity properties.
+		leftVal := s.sortValue(lke, o)
+		rightVal := s.sortValue(rke, o)
 
-		var leftVal interface{}
-
-		// Does the left field exist and is it exported.
-		leftStructField, hasLeftField := leftEntity.Type().FieldByName(o.Name)
-		if hasLeftField && leftStructField.PkgPath == "" {
-			leftVal = leftEntity.FieldByName(o.Name).Interface()
-		}
-
-		var rightVal interface{}
-
-		// Does the right field exist and is it exported.
-		rightStructField, hasRightField := rightEntity.Type().FieldByName(
-			o.Name)
-		if hasRightField && rightStructField.PkgPath == "" {
-			rightVal = rightEntity.FieldByName(o.Name).Interface()
-		}
-
-		switch {
-		case leftVal == nil && rightVal == nil:
-			return false
-		case leftVal == nil:
-			return true
-		case rightVal == nil:
-			return false
-		default:
-			comp := compareValues(leftVal, rightVal)
-			if comp < 0 {
-				return o.Dir == datastore.AscDir
-			} else if comp > 0 {
-				return o.Dir == datastore.DescDir
-			}
-			// Loop around to the next sort order if possible as properties are
-			// equal at this point.
+		comp := compareValues(leftVal, rightVal)
+		if comp < 0 {
+			return o.Dir == datastore.AscDir
+		} else if comp > 0 {
+			return o.Dir == datastore.DescDir
 		}
+		// Loop around to the next sort order if possible as properties are
+		// equal at this point.
 	}
-
-	// Values are at least equal.
 	return false
 }
 
-func (ds *ds) AllocateKeys(key datastore.Key, n int) ([]datastore.Key, error) {
+func (ds *Datastore) AllocateKeys(key datastore.Key, n int) (
+	[]datastore.Key, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
 	baseKey := key.Parent()
 	if baseKey == nil {
 		baseKey = datastore.NewKey(key.Namespace())
 	}
 
+	first := ds.allocator.allocate(key, n)
+	if err := ds.persist(nil); err != nil {
+		return nil, err
+	}
 	keys := make([]datastore.Key, n)
 	for i := range keys {
-		keys[i] = baseKey.IntID(key.Kind(), ds.nextIntID())
+		keys[i] = baseKey.IntID(key.Kind(), first+int64(i))
 	}
 	return keys, nil
 }
 
-func findFieldName(entity interface{}, fieldOrTagName string) string {
+func (ds *Datastore) AllocateKeyRange(key datastore.Key,
+	start, end int64) error {
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
 
-	ty := reflect.TypeOf(entity)
-	if _, exists := ty.FieldByName(fieldOrTagName); exists {
-		return fieldOrTagName
+	switch {
+	case key.Kind() == "":
+		return errors.New("memds: AllocateKeyRange given an empty kind")
+	case start < 1 || end < 1:
+		return errors.New("memds: AllocateKeyRange start and end must " +
+			"both be greater than 0")
+	case start > end:
+		return errors.New("memds: AllocateKeyRange start must be before end")
+	}
+
+	// Like production the range is reserved before checking for problems.
+	seq := ds.allocator.sequence(key)
+	last := seq.last
+	if end > seq.last {
+		ds.allocator.setLast(seq, end)
+	}
+	if err := ds.persist(nil); err != nil {
+		return err
 	}
 
-	// Field name doesn't exist so see if it maps to a user defined tag name.
-	for i := 0; i < ty.NumField(); i++ {
-		field := ty.Field(i)
-		propName := ids.PropertyName(field)
-		if propName == fieldOrTagName {
-			return field.Name
+	// Collisions are found with a global query so they are only eventually
+	// consistent.
+	ds.applyPolicy()
+	for _, ke := range ds.store.all() {
+		id, ok := ke.key.ID().(int64)
+		if ok && id >= start && id <= end && seq.matches(ke.key) {
+			return fmt.Errorf("memds: collision with existing entities "+
+				"in key range [%d, %d]", start, end)
 		}
 	}
 
-	// No field found with specific name.
-	return ""
+	if start <= last {
+		return fmt.Errorf("memds: IDs in key range [%d, %d] may already "+
+			"have been allocated", start, end)
+	}
+	return nil
 }
 
 func isAncestor(ancestor, key datastore.Key) bool {
@@ -570,6 +739,11 @@ func isAncestor(ancestor, key datastore.Key) bool {
 func isComparisonTrue(left interface{},
 	op datastore.FilterOp, right interface{}) bool {
 
+	// Like production, filters only match values that sort with the same
+	// type as the filter value.
+	if typeOrder(left) != typeOrder(right) {
+		return false
+	}
 	comp := compareValues(left, right)
 
 	switch op {
@@ -588,98 +762,132 @@ func isComparisonTrue(left interface{},
 	}
 }
 
-func isIndexableSlice(propValue interface{}) bool {
-	ty := reflect.TypeOf(propValue)
-	if ty.Kind() != reflect.Slice {
-		return false
+func (ds *Datastore) Run(q datastore.Query) (datastore.Iterator, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if err := ds.checkIndex(q); err != nil {
+		return nil, err
 	}
 
-	// Check this propValue slice isn't a []byte.
-	return ty.Elem().Kind() != reflect.Uint8
-}
+	// Ancestor queries are strongly consistent whereas global queries only see
+	// the writes the consistency policy has chosen to apply so far.
+	if q.Ancestor != nil {
+		ds.applyGroup(q.Ancestor)
+	} else {
+		ds.applyPolicy()
+	}
+
+	// Metadata queries run against entities describing the stored entities.
+	candidates := ds.store.all()
+	if metadata, ok := ds.metadataEntities(q); ok {
+		candidates = metadata
+	}
 
-func (ds *ds) Run(q datastore.Query) (datastore.Iterator, error) {
+	filterValues := make([]interface{}, len(q.Filters))
+	for i, f := range q.Filters {
+		if err := validateFilterValue(f.Value); err != nil {
+			return nil, err
+		}
+		filterValues[i] = normalizeValue(f.Value)
+	}
 
-	indexesToRemove := map[int]struct{}{}
+	indexesToRemove := make([]bool, len(candidates))
 
 	// Find entites to remove from our final iteration result.
-	for i, ke := range ds.keyEntities {
+	for i, ke := range candidates {
 		if q.Namespace != ke.key.Namespace() {
-			indexesToRemove[i] = struct{}{}
+			indexesToRemove[i] = true
 		}
 
-		if q.Kind == "" {
-			// Don't filter on kind if it is empty.
-			continue
-		} else if ke.key.Kind() != q.Kind {
-			indexesToRemove[i] = struct{}{}
+		// Kindless queries match every kind.
+		if q.Kind != "" && ke.key.Kind() != q.Kind {
+			indexesToRemove[i] = true
 		}
 
 		// Remove non-ancestors.
 		if q.Ancestor != nil {
 			if !isAncestor(q.Ancestor, ke.key) {
-				indexesToRemove[i] = struct{}{}
+				indexesToRemove[i] = true
 			}
 		}
 
-		for _, f := range q.Filters {
-
-			if err := validateFilterValue(f.Value); err != nil {
-				return nil, err
+		// Missing and unindexed properties are not in any index so entities
+		// cannot be ordered by them.
+		for _, o := range q.Orders {
+			if o.Name == datastore.KeyName {
+				continue
 			}
+			_, noIndex, exists := ke.entity.property(o.Name)
+			if !exists || noIndex {
+				indexesToRemove[i] = true
+			}
+		}
+
+		for j, f := range q.Filters {
+			filterValue := filterValues[j]
 
 			var propValue interface{}
 
 			if f.Name == datastore.KeyName {
 				// Filter by entity key.
 				propValue = ke.key
-			} else if fieldName := findFieldName(
-				ke.entity, f.Name); fieldName != "" {
-				propValue = reflect.ValueOf(
-					ke.entity).FieldByName(fieldName).Interface()
 			} else {
-				// No property to filter on so continue to next filter.
-				continue
+				// Nor can they be filtered on.
+				value, noIndex, exists := ke.entity.property(f.Name)
+				if !exists || noIndex {
+					indexesToRemove[i] = true
+					continue
+				}
+				propValue = value
 			}
 
-			// Cater for entity property slices. If any of the elements in a
-			// slice is not a filter match then don't remove the entity from
-			// the iteration candidates. Note that a []byte is not indexable
-			// and is treated as a single property.
-			if isIndexableSlice(propValue) {
-				shouldRemove := true
-				v := reflect.ValueOf(propValue)
-				for j := 0; j < v.Len(); j++ {
-					if isComparisonTrue(v.Index(j).Interface(),
-						f.Op, f.Value) {
-						shouldRemove = false
-						break
-					}
-				}
-				if shouldRemove {
-					indexesToRemove[i] = struct{}{}
+			// Cater for multi-valued properties. If any of the values is a
+			// filter match then don't remove the entity from the iteration
+			// candidates. Entities are only returned once however many of
+			// their values match.
+			values, ok := propValue.([]interface{})
+			if !ok {
+				values = []interface{}{propValue}
+			}
+			matched := false
+			for _, value := range values {
+				if !isComparisonTrue(value, f.Op, filterValue) {
+					continue
 				}
-			} else {
-				if !isComparisonTrue(propValue, f.Op, f.Value) {
-					indexesToRemove[i] = struct{}{}
+
+				// Like a production index scan, one value must match all of
+				// the inequality filters on a property.
+				if f.Op != datastore.EqualOp &&
+					!matchesInequalities(value, f.Name, q.Filters) {
+					continue
 				}
+				matched = true
+				break
+			}
+			if !matched {
+				indexesToRemove[i] = true
 			}
 		}
 	}
 
 	keyEntities := []keyEntity{}
-	for i, ke := range ds.keyEntities {
-		if _, remove := indexesToRemove[i]; remove {
+	for i, ke := range candidates {
+		if indexesToRemove[i] {
 			continue
 		}
 		keyEntities = append(keyEntities, ke)
 	}
 
-	// Execute orders.
-	sort.Sort(&keyEntitySorter{
-		keyEntities: keyEntities,
-		orders:      q.Orders,
-	})
+	// Execute orders. The candidates are in key order so, like production,
+	// a stable sort returns entities with equal values in key order.
+	if len(q.Orders) > 0 {
+		sort.Stable(&keyEntitySorter{
+			keyEntities: keyEntities,
+			orders:      q.Orders,
+			filters:     q.Filters,
+		})
+	}
 
 	return &iterator{
 		keyEntities: keyEntities,
@@ -689,7 +897,8 @@ func (ds *ds) Run(q datastore.Query) (datastore.Iterator, error) {
 
 func validateFilterValue(value interface{}) error {
 	switch value.(type) {
-	case int64, float64, datastore.Key, string:
+	case nil, int64, float64, bool, string, []byte, time.Time,
+		datastore.GeoPoint, datastore.Key:
 		return nil
 	default:
 		return fmt.Errorf("unsupported filter value type %T", value)
@@ -732,63 +941,71 @@ func (it *iterator) Next(entity interface{}) (datastore.Key, error) {
 	if err != nil {
 		return nil, err
 	}
-	val.Set(reflect.ValueOf(keyEntity.entity))
-	return keyEntity.key, nil
+	return keyEntity.key, loadStruct(keyEntity.entity, val)
 }
 
-func (ds *ds) RunInTransaction(f func(datastore.Datastore) error) error {
+// RunInTransaction calls f without holding the lock on ds so f can use ds
+// itself. Only the commit is done with ds locked.
+func (ds *Datastore) RunInTransaction(f func(datastore.Datastore) error) error {
 	txDs := &txDs{
-		ds: ds,
+		ds:    ds,
+		start: ds.clock.Now(),
 	}
 	if err := f(txDs); err != nil {
 		return err
 	}
-	for _, m := range txDs.mutators {
-		if err := m(ds); err != nil {
-			return err
-		}
+	if err := txDs.expired(); err != nil {
+		return err
 	}
-	return nil
+
+	ds.mu.Lock()
+	defer ds.unlock()
+	ds.transactions++
+	return ds.write(txDs.mutations, ds.transactions)
 }
 
 type txDs struct {
-	ds       *ds
-	mutators []func(ds datastore.Datastore) error
+	ds        *Datastore
+	start     time.Time
+	mutations []mutation
 }
 
 func (ds *txDs) Get(keys []datastore.Key, entities interface{}) error {
+	if err := ds.expired(); err != nil {
+		return err
+	}
 	return ds.ds.Get(keys, entities)
 }
 
-func (ds *txDs) Put(keys []datastore.Key, entities interface{}) ([]datastore.Key, error) {
+func (ds *txDs) Put(keys []datastore.Key, entities interface{}) (
+	[]datastore.Key, error) {
+
+	if err := ds.expired(); err != nil {
+		return nil, err
+	}
 
 	// Return complete keys witin the transaction by automatically completing
-	// them even though ds.Put isn't actually called yet.
-	completeKeys := make([]datastore.Key, len(keys))
-	for i, k := range keys {
-		completeKey := k
-		if k.Incomplete() {
-			baseKey := k.Parent()
-			if baseKey == nil {
-				baseKey = datastore.NewKey(k.Namespace())
-			}
-			completeKey = baseKey.IntID(k.Kind(), ds.ds.nextIntID())
-
-		}
-		completeKeys[i] = completeKey
+	// them even though the mutations aren't written until commit.
+	ds.ds.mu.Lock()
+	mutations, err := ds.ds.putMutations(keys, entities)
+	ds.ds.mu.Unlock()
+	if err != nil {
+		return nil, err
 	}
+	ds.mutations = append(ds.mutations, mutations...)
 
-	ds.mutators = append(ds.mutators, func(ds datastore.Datastore) error {
-		_, err := ds.Put(completeKeys, entities)
-		return err
-	})
+	completeKeys := make([]datastore.Key, len(mutations))
+	for i, m := range mutations {
+		completeKeys[i] = m.key
+	}
 	return completeKeys, nil
 }
 
 func (ds *txDs) Delete(keys []datastore.Key) error {
-	ds.mutators = append(ds.mutators, func(ds datastore.Datastore) error {
-		return ds.Delete(keys)
-	})
+	if err := ds.expired(); err != nil {
+		return err
+	}
+	ds.mutations = append(ds.mutations, deleteMutations(keys)...)
 	return nil
 }
 
@@ -796,6 +1013,11 @@ func (ds *txDs) AllocateKeys(key datastore.Key, n int) ([]datastore.Key, error)
 	return ds.ds.AllocateKeys(key, n)
 }
 
+func (ds *txDs) AllocateKeyRange(key datastore.Key,
+	start, end int64) error {
+	return ds.ds.AllocateKeyRange(key, start, end)
+}
+
 func (ds *txDs) Run(q datastore.Query) (datastore.Iterator, error) {
 	return nil, errors.New("not implemented")
 }
@@ -81,6 +81,27 @@ func (cds *compareDs) AllocateKeys(key datastore.Key, n int) (
 	return compKeys[0], nil
 }
 
+func (cds *compareDs) AllocateKeyRange(key datastore.Key,
+	start, end int64) error {
+
+	compErrs := make([]error, len(*cds))
+	for i, ds := range *cds {
+		compErrs[i] = datastore.AllocateKeyRange(ds, key, start, end)
+	}
+
+	// Error messages differ so only check that all or none failed.
+	for i, ce := range compErrs {
+		if i >= len(compErrs)-1 {
+			break
+		}
+		if (ce == nil) != (compErrs[i+1] == nil) {
+			return fmt.Errorf("allocate key range errors not equal %v vs %v",
+				ce, compErrs[i+1])
+		}
+	}
+	return compErrs[0]
+}
+
 func (cds *compareDs) Get(keys []datastore.Key, entities interface{}) error {
 
 	ty := reflect.TypeOf(entities)
@@ -937,6 +958,157 @@ func TestIntIDKeyOrder(t *testing.T) {
 	}
 }
 
+func TestKindlessQuery(t *testing.T) {
+	ctx, closeFunc := newContext(t, true)
+	defer closeFunc()
+
+	ds := &compareDs{
+		ds.New(ctx),
+		memds.New(),
+	}
+
+	type testEntity struct {
+		Value int64
+	}
+
+	parent := datastore.NewKey("").IntID("A", 1)
+	child := parent.IntID("B", 2)
+	other := datastore.NewKey("").IntID("C", 3)
+	if _, err := ds.Put([]datastore.Key{parent, child, other},
+		make([]testEntity, 3)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query datastore.Query
+		count int
+	}{
+		{datastore.Query{}, 3},
+
+		// Ancestor queries only match the ancestor's entity group.
+		{datastore.Query{Ancestor: parent}, 2},
+
+		// Keys are compared by their whole path.
+		{datastore.Query{
+			Filters: []datastore.Filter{
+				{datastore.KeyName, datastore.GreaterThanOp, child},
+			},
+		}, 1},
+		{datastore.Query{
+			Ancestor: parent,
+			Filters: []datastore.Filter{
+				{datastore.KeyName, datastore.GreaterThanOp, parent},
+			},
+		}, 1},
+	}
+	for i, test := range tests {
+		if count := countQuery(t, ds, test.query); count != test.count {
+			t.Fatal(i, "expected", test.count, "entities got", count)
+		}
+	}
+
+	// Filter values are validated even without a kind.
+	if _, err := ds.Run(datastore.Query{
+		Filters: []datastore.Filter{
+			{datastore.KeyName, datastore.GreaterThanOp, int32(1)},
+		},
+	}); err == nil {
+		t.Fatal("expected invalid filter value error")
+	}
+}
+
+func TestKeyPathOrder(t *testing.T) {
+	ctx, closeFunc := newContext(t, true)
+	defer closeFunc()
+
+	ds := &compareDs{
+		ds.New(ctx),
+		memds.New(),
+	}
+
+	type testEntity struct {
+		KeyValue datastore.Key
+	}
+
+	root := datastore.NewKey("a")
+	values := []datastore.Key{
+		// Check a parent comes before its children.
+		root.IntID("Parent", 1),
+		root.IntID("Parent", 1).IntID("Child", 1),
+
+		// Check integer and string IDs are mixed within a path.
+		root.IntID("Parent", 1).StringID("Child", "a"),
+		root.StringID("Parent", "a").IntID("Child", 1),
+
+		// Check paths of different depths are compared element by element.
+		root.IntID("Parent", 2),
+		root.IntID("Parent", 1).IntID("Child", 1).IntID("Leaf", 1),
+		root.IntID("A", 3).IntID("Child", 1),
+
+		// Check namespaces are compared first.
+		datastore.NewKey("").IntID("Parent", 1),
+		datastore.NewKey("b").IntID("A", 1),
+	}
+
+	// Give each entity a key under the key it holds so ordering by key
+	// checks the same paths.
+	keys := make([]datastore.Key, len(values))
+	entities := make([]*testEntity, len(values))
+	for i, value := range values {
+		keys[i] = root.IntID("Owner", int64(i+1)).IntID("Test", 1)
+		if value.Namespace() == root.Namespace() {
+			keys[i] = value.IntID("Test", 1)
+		}
+		entities[i] = &testEntity{
+			KeyValue: value,
+		}
+	}
+	if _, err := ds.Put(keys, entities); err != nil {
+		t.Fatal(err)
+	}
+
+	// The indexes of keys in ascending order. Path elements are compared in
+	// turn from the root by kind and then ID.
+	byValue := []int{7, 6, 0, 1, 5, 2, 4, 3, 8}
+	byKey := []int{6, 7, 8, 5, 1, 2, 0, 4, 3}
+
+	// The compareDs implementation of ds.Ds will also check the order is the
+	// same as the App Engine datastore.
+	for _, test := range []struct {
+		order    datastore.Order
+		expected []int
+	}{
+		{datastore.Order{"KeyValue", datastore.AscDir}, byValue},
+		{datastore.Order{"KeyValue", datastore.DescDir}, byValue},
+		{datastore.Order{datastore.KeyName, datastore.AscDir}, byKey},
+		{datastore.Order{datastore.KeyName, datastore.DescDir}, byKey},
+	} {
+		iter, err := ds.Run(datastore.Query{
+			Namespace: "a",
+			Kind:      "Test",
+			Orders:    []datastore.Order{test.order},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range test.expected {
+			key, err := iter.Next(&testEntity{})
+			if err != nil {
+				t.Fatal(test.order, err)
+			}
+
+			expected := test.expected[i]
+			if test.order.Dir == datastore.DescDir {
+				expected = test.expected[len(test.expected)-1-i]
+			}
+			if key == nil || !key.Equal(keys[expected]) {
+				t.Fatal(test.order, i, "expected", keys[expected],
+					"got", key)
+			}
+		}
+	}
+}
+
 func TestStructTags(t *testing.T) {
 	ctx, closeFunc := newContext(t, true)
 	defer closeFunc()
@@ -1005,6 +1177,50 @@ func TestStructTags(t *testing.T) {
 	}
 }
 
+func TestStructTagOrder(t *testing.T) {
+	ctx, closeFunc := newContext(t, true)
+	defer closeFunc()
+
+	ds := &compareDs{
+		ds.New(ctx),
+		memds.New(),
+	}
+
+	type testEntity struct {
+		Value int64 `datastore:"renamed"`
+	}
+
+	for i := 0; i < 5; i++ {
+		key := datastore.NewKey("").StringID("Test", strconv.Itoa(i))
+		if _, err := ds.Put([]datastore.Key{key},
+			[]*testEntity{&testEntity{int64(i)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	iter, err := ds.Run(datastore.Query{
+		Kind: "Test",
+		Orders: []datastore.Order{
+			{"renamed", datastore.DescDir},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		te := &testEntity{}
+		if key, err := iter.Next(te); err != nil {
+			t.Fatal(err)
+		} else if key == nil {
+			t.Fatal("expected key")
+		}
+		if te.Value != int64(4-i) {
+			t.Fatal("incorrect order", te)
+		}
+	}
+}
+
 func TestSliceProperties(t *testing.T) {
 	ctx, closeFunc := newContext(t, true)
 	defer closeFunc()
@@ -1163,3 +1379,530 @@ func TestByteSliceProperties(t *testing.T) {
 		t.Fatal("incorrect byte values", getEntity.ByteValue)
 	}
 }
+
+func TestNoIndexQuery(t *testing.T) {
+	ctx, closeFunc := newContext(t, true)
+	defer closeFunc()
+
+	ds := &compareDs{
+		ds.New(ctx),
+		memds.New(),
+	}
+
+	type testEntity struct {
+		Indexed   int64
+		Unindexed int64 `datastore:",noindex"`
+		Blob      []byte
+	}
+
+	keys := []datastore.Key{
+		datastore.NewKey("").IntID("Test", 1),
+		datastore.NewKey("").IntID("Test", 2),
+	}
+	entities := []*testEntity{
+		{1, 1, []byte("a")},
+		{2, 2, []byte("b")},
+	}
+	if _, err := ds.Put(keys, entities); err != nil {
+		t.Fatal(err)
+	}
+
+	queries := []datastore.Query{
+		{
+			Kind: "Test",
+			Filters: []datastore.Filter{
+				{"Unindexed", datastore.EqualOp, int64(1)},
+			},
+		},
+		{
+			Kind:   "Test",
+			Orders: []datastore.Order{{"Unindexed", datastore.AscDir}},
+		},
+		{
+			Kind:   "Test",
+			Orders: []datastore.Order{{"Blob", datastore.AscDir}},
+		},
+	}
+
+	// Unindexed properties should never return any entities.
+	for i, q := range queries {
+		iter, err := ds.Run(q)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if key, err := iter.Next(&testEntity{}); err != nil {
+			t.Fatal(i, err)
+		} else if key != nil {
+			t.Fatal(i, "expected no key got", key)
+		}
+	}
+}
+
+func TestMissingProperties(t *testing.T) {
+	ctx, closeFunc := newContext(t, true)
+	defer closeFunc()
+
+	ds := &compareDs{
+		ds.New(ctx),
+		memds.New(),
+	}
+
+	type withValue struct {
+		Value datastore.Key
+	}
+	type withoutValue struct {
+		Other int64
+	}
+
+	keys := []datastore.Key{
+		datastore.NewKey("").IntID("Test", 1),
+		datastore.NewKey("").IntID("Test", 2),
+		datastore.NewKey("").IntID("Test", 3),
+	}
+	entities := []interface{}{
+		&withValue{datastore.NewKey("").IntID("Value", 1)},
+		&withValue{nil},
+		&withoutValue{3},
+	}
+	if _, err := ds.Put(keys, entities); err != nil {
+		t.Fatal(err)
+	}
+
+	queries := []struct {
+		q    datastore.Query
+		keys []datastore.Key
+	}{
+		{
+			datastore.Query{
+				KeysOnly: true,
+				Kind:     "Test",
+				Orders:   []datastore.Order{{"Value", datastore.AscDir}},
+			},
+			[]datastore.Key{keys[1], keys[0]},
+		},
+		{
+			datastore.Query{
+				KeysOnly: true,
+				Kind:     "Test",
+				Filters: []datastore.Filter{
+					{"Value", datastore.EqualOp, nil},
+				},
+			},
+			[]datastore.Key{keys[1]},
+		},
+		{
+			datastore.Query{
+				KeysOnly: true,
+				Kind:     "Test",
+				Filters: []datastore.Filter{
+					{"Other", datastore.GreaterThanOp, int64(0)},
+				},
+			},
+			[]datastore.Key{keys[2]},
+		},
+	}
+
+	for i, query := range queries {
+		iter, err := ds.Run(query.q)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		for _, expected := range query.keys {
+			key, err := iter.Next(nil)
+			if err != nil {
+				t.Fatal(i, err)
+			}
+			if key == nil || !key.Equal(expected) {
+				t.Fatal(i, "expected key", expected, "got", key)
+			}
+		}
+		if key, err := iter.Next(nil); err != nil {
+			t.Fatal(i, err)
+		} else if key != nil {
+			t.Fatal(i, "expected no key got", key)
+		}
+	}
+}
+
+func TestGetDifferentStruct(t *testing.T) {
+	ds := memds.New()
+
+	type writeModel struct {
+		Name   string
+		Tags   []string
+		Count  int64
+		Hidden string `datastore:"-"`
+	}
+	type readModel struct {
+		Name  string
+		Count string
+		Extra float64
+	}
+
+	key := datastore.NewKey("").StringID("Test", "a")
+	if _, err := ds.Put([]datastore.Key{key}, []*writeModel{
+		{"name", []string{"a", "b"}, 3, "hidden"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Properties without a field or of a different type are reported but
+	// the other fields are still loaded. Fields without a property are left
+	// unchanged.
+	read := &readModel{Count: "stale", Extra: 1}
+	err := ds.Get([]datastore.Key{key}, []*readModel{read})
+	if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+		t.Fatal("expected field mismatch error got", err)
+	}
+	expected := readModel{Name: "name", Count: "stale", Extra: 1}
+	if *read != expected {
+		t.Fatalf("expected %+v got %+v", expected, *read)
+	}
+
+	// Loading back into the original struct restores all saved fields.
+	write := &writeModel{}
+	if err := ds.Get([]datastore.Key{key},
+		[]*writeModel{write}); err != nil {
+		t.Fatal(err)
+	}
+	if write.Name != "name" || write.Count != 3 || write.Hidden != "" ||
+		!reflect.DeepEqual(write.Tags, []string{"a", "b"}) {
+		t.Fatalf("incorrect entity %+v", *write)
+	}
+}
+
+func TestFieldMismatch(t *testing.T) {
+	ctx, closeFunc := newContext(t, true)
+	defer closeFunc()
+
+	ds := &compareDs{
+		memds.New(),
+		ds.New(ctx),
+	}
+
+	type writeModel struct {
+		Name  string
+		Count int64
+		Size  int64
+	}
+	type readModel struct {
+		Name  string
+		Count string
+	}
+
+	key := datastore.NewKey("").StringID("Test", "a")
+	if _, err := ds.Put([]datastore.Key{key}, []*writeModel{
+		{"name", 3, 4},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both backends report the first property that cannot be loaded with the
+	// same error.
+	read := &readModel{}
+	err := ds.Get([]datastore.Key{key}, []*readModel{read})
+	if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+		t.Fatal("expected field mismatch error got", err)
+	}
+	if read.Name != "name" {
+		t.Fatalf("incorrect entity %+v", *read)
+	}
+
+	iter, err := ds.Run(datastore.Query{
+		Kind: "Test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	read = &readModel{}
+	iterKey, err := iter.Next(read)
+	if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+		t.Fatal("expected field mismatch error got", err)
+	}
+	if !key.Equal(iterKey) || read.Name != "name" {
+		t.Fatalf("incorrect entity %v %+v", iterKey, *read)
+	}
+}
+
+func TestSliceIsolation(t *testing.T) {
+	ds := memds.New()
+
+	type testEntity struct {
+		Strings []string
+		Ints    []int64
+		Bytes   []byte
+	}
+	expected := testEntity{
+		Strings: []string{"a", "b"},
+		Ints:    []int64{1, 2},
+		Bytes:   []byte("ab"),
+	}
+
+	put := &testEntity{
+		Strings: []string{"a", "b"},
+		Ints:    []int64{1, 2},
+		Bytes:   []byte("ab"),
+	}
+	key := datastore.NewKey("").StringID("Test", "a")
+	if _, err := ds.Put([]datastore.Key{key},
+		[]*testEntity{put}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Mutating the put entity must not change the stored entity.
+	put.Strings[0], put.Ints[0], put.Bytes[0] = "z", 9, 'z'
+
+	get := &testEntity{}
+	if err := ds.Get([]datastore.Key{key},
+		[]*testEntity{get}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*get, expected) {
+		t.Fatalf("stored entity changed after put %+v", *get)
+	}
+
+	// Nor must mutating a loaded entity.
+	get.Strings[0], get.Ints[0], get.Bytes[0] = "z", 9, 'z'
+
+	iter, err := ds.Run(datastore.Query{Kind: "Test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := &testEntity{}
+	if _, err := iter.Next(next); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*next, expected) {
+		t.Fatalf("stored entity changed after get %+v", *next)
+	}
+}
+
+func TestTimeNormalisation(t *testing.T) {
+	ds := memds.New()
+
+	type testEntity struct {
+		Time  time.Time
+		Times []time.Time
+	}
+
+	loc := time.FixedZone("test", 3600)
+	putTime := time.Date(2016, 1, 2, 3, 4, 5, 123456789, loc)
+	expected := time.Date(2016, 1, 2, 2, 4, 5, 123456000, time.UTC)
+
+	key := datastore.NewKey("").StringID("Test", "a")
+	if _, err := ds.Put([]datastore.Key{key}, []*testEntity{
+		{putTime, []time.Time{putTime}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	get := &testEntity{}
+	if err := ds.Get([]datastore.Key{key},
+		[]*testEntity{get}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*get, testEntity{
+		expected, []time.Time{expected},
+	}) {
+		t.Fatalf("times not normalised %+v", *get)
+	}
+
+	// Filter values are normalised in the same way.
+	for _, name := range []string{"Time", "Times"} {
+		iter, err := ds.Run(datastore.Query{
+			Kind:     "Test",
+			KeysOnly: true,
+			Filters: []datastore.Filter{
+				{name, datastore.EqualOp, putTime},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key, err := iter.Next(nil); err != nil {
+			t.Fatal(err)
+		} else if key == nil {
+			t.Fatal("expected key for", name)
+		}
+	}
+}
+
+func TestMultiValueOrder(t *testing.T) {
+	ds := memds.New()
+
+	type testEntity struct {
+		Values []int64
+	}
+
+	keys := []datastore.Key{
+		datastore.NewKey("").StringID("Test", "a"),
+		datastore.NewKey("").StringID("Test", "b"),
+		datastore.NewKey("").StringID("Test", "c"),
+		datastore.NewKey("").StringID("Test", "d"),
+	}
+	if _, err := ds.Put(keys, []testEntity{
+		{[]int64{1, 10}},
+		{[]int64{5, 6}},
+		{[]int64{3, 4}},
+		{[]int64{6, 5}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		filters []datastore.Filter
+		dir     datastore.OrderDir
+		keys    []string
+	}{
+		// Ascending sorts by the smallest value and equal values are in key
+		// order.
+		{nil, datastore.AscDir, []string{"a", "c", "b", "d"}},
+
+		// Descending sorts by the largest value.
+		{nil, datastore.DescDir, []string{"a", "b", "d", "c"}},
+
+		// Only values matching an inequality filter are sorted and entities
+		// are returned once even if several values match.
+		{
+			[]datastore.Filter{
+				{"Values", datastore.GreaterThanOp, int64(3)},
+			},
+			datastore.AscDir,
+			[]string{"c", "b", "d", "a"},
+		},
+
+		// One value must match every inequality filter.
+		{
+			[]datastore.Filter{
+				{"Values", datastore.GreaterThanOp, int64(4)},
+				{"Values", datastore.LessThanOp, int64(6)},
+			},
+			datastore.AscDir,
+			[]string{"b", "d"},
+		},
+	}
+
+	for i, test := range tests {
+		iter, err := ds.Run(datastore.Query{
+			Kind:     "Test",
+			Filters:  test.filters,
+			Orders:   []datastore.Order{{"Values", test.dir}},
+			KeysOnly: true,
+		})
+		if err != nil {
+			t.Fatal(i, err)
+		}
+
+		ids := []string{}
+		for {
+			key, err := iter.Next(nil)
+			if err != nil {
+				t.Fatal(i, err)
+			} else if key == nil {
+				break
+			}
+			ids = append(ids, key.ID().(string))
+		}
+		if !reflect.DeepEqual(ids, test.keys) {
+			t.Fatal(i, "expected", test.keys, "got", ids)
+		}
+	}
+}
+
+func TestFilterValueTypes(t *testing.T) {
+	ds := memds.New()
+
+	type intEntity struct{ Value int64 }
+	type timeEntity struct{ Value time.Time }
+	type boolEntity struct{ Value bool }
+	type stringEntity struct{ Value string }
+	type floatEntity struct{ Value float64 }
+	type geoPointEntity struct{ Value datastore.GeoPoint }
+	type keyEntity struct{ Value datastore.Key }
+
+	keys := []datastore.Key{
+		datastore.NewKey("").StringID("Test", "key"),
+		datastore.NewKey("").StringID("Test", "geopoint"),
+		datastore.NewKey("").StringID("Test", "float"),
+		datastore.NewKey("").StringID("Test", "string"),
+		datastore.NewKey("").StringID("Test", "bool"),
+		datastore.NewKey("").StringID("Test", "int"),
+		datastore.NewKey("").StringID("Test", "time"),
+		datastore.NewKey("").StringID("Test", "null"),
+	}
+	entities := []interface{}{
+		&keyEntity{datastore.NewKey("").StringID("Other", "a")},
+		&geoPointEntity{datastore.GeoPoint{Lat: 1, Lng: 2}},
+		&floatEntity{1.5},
+		&stringEntity{"b"},
+		&boolEntity{true},
+		&intEntity{5},
+		&timeEntity{time.Unix(0, 3000)},
+		&keyEntity{nil},
+	}
+	if _, err := ds.Put(keys, entities); err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(q datastore.Query) []string {
+		q.Kind = "Test"
+		q.KeysOnly = true
+		iter, err := ds.Run(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []string{}
+		for {
+			key, err := iter.Next(nil)
+			if err != nil {
+				t.Fatal(err)
+			} else if key == nil {
+				return ids
+			}
+			ids = append(ids, key.ID().(string))
+		}
+	}
+
+	// Times are ordered with integers by their microseconds.
+	ids := run(datastore.Query{
+		Orders: []datastore.Order{{"Value", datastore.AscDir}},
+	})
+	expected := []string{"null", "time", "int", "bool", "string", "float",
+		"geopoint", "key"}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Fatal("expected", expected, "got", ids)
+	}
+
+	tests := []struct {
+		filter datastore.Filter
+		ids    []string
+	}{
+		{datastore.Filter{"Value", datastore.EqualOp, nil}, []string{"null"}},
+		{datastore.Filter{"Value", datastore.EqualOp, true}, []string{"bool"}},
+		{
+			datastore.Filter{"Value", datastore.EqualOp, time.Unix(0, 3000)},
+			[]string{"time"},
+		},
+		{
+			datastore.Filter{"Value", datastore.GreaterThanOp, int64(4)},
+			[]string{"int"},
+		},
+		{
+			datastore.Filter{"Value", datastore.EqualOp, []byte("b")},
+			[]string{"string"},
+		},
+		{
+			datastore.Filter{"Value", datastore.EqualOp,
+				datastore.GeoPoint{Lat: 1, Lng: 2}},
+			[]string{"geopoint"},
+		},
+	}
+	for i, test := range tests {
+		ids := run(datastore.Query{
+			Filters: []datastore.Filter{test.filter},
+		})
+		if !reflect.DeepEqual(ids, test.ids) {
+			t.Fatal(i, "expected", test.ids, "got", ids)
+		}
+	}
+}
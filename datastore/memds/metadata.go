@@ -0,0 +1,166 @@
+package memds
+
+import (
+	"sort"
+	"time"
+
+	"github.com/qedus/appengine/datastore"
+)
+
+// representation returns the production metadata name for the type of
+// value.
+func representation(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "NULL"
+	case int64, time.Time:
+		return "INT64"
+	case bool:
+		return "BOOLEAN"
+	case string, []byte:
+		return "STRING"
+	case float64:
+		return "DOUBLE"
+	case datastore.GeoPoint:
+		return "POINT"
+	case datastore.Key:
+		return "REFERENCE"
+	}
+	return ""
+}
+
+// metadataEntities returns the entities that production's metadata kinds
+// would contain for the stored entities. ok is false if q is not a metadata
+// query. The entities are returned in key order.
+func (ds *Datastore) metadataEntities(q datastore.Query) (
+	metadata []keyEntity, ok bool) {
+
+	switch q.Kind {
+	case datastore.NamespaceKind:
+		return ds.namespaceEntities(q.Namespace), true
+	case datastore.KindKind:
+		return ds.kindEntities(q.Namespace), true
+	case datastore.PropertyKind:
+		return ds.propertyEntities(q.Namespace), true
+	}
+	return nil, false
+}
+
+func (ds *Datastore) namespaceEntities(namespace string) []keyEntity {
+	namespaces := map[string]bool{}
+	for _, ke := range ds.store.all() {
+		namespaces[ke.key.Namespace()] = true
+	}
+
+	names := make([]string, 0, len(namespaces))
+	for name := range namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	metadata := make([]keyEntity, len(names))
+	for i, name := range names {
+		// The default namespace has an integer ID of 1.
+		key := datastore.NewKey(namespace)
+		if name == "" {
+			key = key.IntID(datastore.NamespaceKind, 1)
+		} else {
+			key = key.StringID(datastore.NamespaceKind, name)
+		}
+		metadata[i] = keyEntity{
+			key:    key,
+			entity: propertyList{},
+		}
+	}
+	return metadata
+}
+
+func (ds *Datastore) kindEntities(namespace string) []keyEntity {
+	kinds := map[string]bool{}
+	for _, ke := range ds.store.all() {
+		if ke.key.Namespace() == namespace {
+			kinds[ke.key.Kind()] = true
+		}
+	}
+
+	names := make([]string, 0, len(kinds))
+	for name := range kinds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	metadata := make([]keyEntity, len(names))
+	for i, name := range names {
+		metadata[i] = keyEntity{
+			key: datastore.NewKey(namespace).StringID(
+				datastore.KindKind, name),
+			entity: propertyList{},
+		}
+	}
+	return metadata
+}
+
+func (ds *Datastore) propertyEntities(namespace string) []keyEntity {
+
+	// Representations of each indexed property of each kind.
+	kinds := map[string]map[string]map[string]bool{}
+	for _, ke := range ds.store.all() {
+		if ke.key.Namespace() != namespace {
+			continue
+		}
+
+		kind := ke.key.Kind()
+		if kinds[kind] == nil {
+			kinds[kind] = map[string]map[string]bool{}
+		}
+		for _, p := range ke.entity {
+			if p.noIndex {
+				continue
+			}
+			if kinds[kind][p.name] == nil {
+				kinds[kind][p.name] = map[string]bool{}
+			}
+			kinds[kind][p.name][representation(p.value)] = true
+		}
+	}
+
+	kindNames := make([]string, 0, len(kinds))
+	for kind := range kinds {
+		kindNames = append(kindNames, kind)
+	}
+	sort.Strings(kindNames)
+
+	metadata := []keyEntity{}
+	for _, kind := range kindNames {
+		kindKey := datastore.NewKey(namespace).StringID(
+			datastore.KindKind, kind)
+
+		names := make([]string, 0, len(kinds[kind]))
+		for name := range kinds[kind] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			reps := make([]string, 0, len(kinds[kind][name]))
+			for rep := range kinds[kind][name] {
+				reps = append(reps, rep)
+			}
+			sort.Strings(reps)
+
+			pl := make(propertyList, len(reps))
+			for i, rep := range reps {
+				pl[i] = property{
+					name:     "property_representation",
+					value:    rep,
+					multiple: true,
+				}
+			}
+			metadata = append(metadata, keyEntity{
+				key:    kindKey.StringID(datastore.PropertyKind, name),
+				entity: pl,
+			})
+		}
+	}
+	return metadata
+}
@@ -0,0 +1,96 @@
+package memds_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/qedus/appengine/datastore"
+	"github.com/qedus/appengine/datastore/memds"
+)
+
+func TestMetadata(t *testing.T) {
+	ds := memds.New()
+
+	type first struct {
+		Name  string
+		Count int64
+		Blob  []byte
+	}
+	type second struct {
+		Count float64
+		Tags  []string
+	}
+
+	keys := []datastore.Key{
+		datastore.NewKey("").StringID("First", "a"),
+		datastore.NewKey("").StringID("Second", "b"),
+		datastore.NewKey("ns").StringID("First", "c"),
+		datastore.NewKey("ns").StringID("Second", "d"),
+	}
+	entities := []interface{}{
+		&first{"a", 1, []byte("a")},
+		&second{2.5, []string{"x"}},
+		&first{"c", 3, nil},
+		&second{4, nil},
+	}
+	if _, err := ds.Put(keys, entities); err != nil {
+		t.Fatal(err)
+	}
+
+	namespaces, err := datastore.Namespaces(ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(namespaces, []string{"", "ns"}) {
+		t.Fatal("incorrect namespaces", namespaces)
+	}
+
+	kinds, err := datastore.Kinds(ds, "ns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(kinds, []string{"First", "Second"}) {
+		t.Fatal("incorrect kinds", kinds)
+	}
+
+	properties, err := datastore.Properties(ds, "", "First")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(properties, map[string][]string{
+		"Name":  {"STRING"},
+		"Count": {"INT64"},
+	}) {
+		t.Fatal("incorrect properties", properties)
+	}
+
+	// Properties of every kind can be queried with __key__ filters.
+	iter, err := ds.Run(datastore.Query{
+		Namespace: "ns",
+		Kind:      datastore.PropertyKind,
+		KeysOnly:  true,
+		Filters: []datastore.Filter{{
+			datastore.KeyName, datastore.GreaterThanOp,
+			datastore.NewKey("ns").StringID(datastore.KindKind, "First"),
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for {
+		key, err := iter.Next(nil)
+		if err != nil {
+			t.Fatal(err)
+		} else if key == nil {
+			break
+		}
+		names = append(names, key.Parent().ID().(string)+"."+
+			key.ID().(string))
+	}
+	if !reflect.DeepEqual(names, []string{
+		"First.Count", "First.Name", "Second.Count",
+	}) {
+		t.Fatal("incorrect property keys", names)
+	}
+}
@@ -0,0 +1,284 @@
+package memds
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/qedus/appengine/datastore"
+	ids "github.com/qedus/appengine/internal/datastore"
+)
+
+// property is a single datastore property value. Slice fields are saved as
+// one property per element with multiple set.
+type property struct {
+	name     string
+	value    interface{}
+	noIndex  bool
+	multiple bool
+}
+
+// propertyList is an entity stored as its properties rather than as a Go
+// struct value so it can be loaded into any struct type.
+type propertyList []property
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	geoPointType = reflect.TypeOf(datastore.GeoPoint{})
+	keyType      = reflect.TypeOf((*datastore.Key)(nil)).Elem()
+)
+
+// isPropertyType returns true if values of type ty can be saved as a property.
+func isPropertyType(ty reflect.Type) bool {
+	switch ty.Kind() {
+	case reflect.Int64, reflect.String, reflect.Float64, reflect.Bool:
+		return true
+	case reflect.Struct:
+		return ty == timeType || ty == geoPointType
+	case reflect.Interface:
+		return ty == keyType
+	}
+	return false
+}
+
+// fieldCodec describes how a struct field is saved as a property.
+type fieldCodec struct {
+	index    int
+	name     string
+	noIndex  bool
+	multiple bool
+}
+
+// structCodec holds the property fields of a struct type so the struct tags
+// are only parsed once per type.
+type structCodec struct {
+	fields []fieldCodec
+	byName map[string]fieldCodec
+}
+
+var (
+	structCodecsMutex sync.Mutex
+	structCodecs      = map[reflect.Type]*structCodec{}
+)
+
+// getStructCodec returns the cached codec for the struct type ty. Property
+// names come from ids.PropertyName so they match the ds backend.
+func getStructCodec(ty reflect.Type) *structCodec {
+	structCodecsMutex.Lock()
+	defer structCodecsMutex.Unlock()
+
+	if codec, exists := structCodecs[ty]; exists {
+		return codec
+	}
+
+	codec := &structCodec{
+		byName: map[string]fieldCodec{},
+	}
+	for i := 0; i < ty.NumField(); i++ {
+		field := ty.Field(i)
+
+		name := ids.PropertyName(field)
+		if name == "" {
+			continue
+		}
+
+		fc := fieldCodec{
+			index:   i,
+			name:    name,
+			noIndex: ids.PropertyNoIndex(field),
+		}
+		switch {
+		case field.Type.Kind() == reflect.Slice &&
+			field.Type.Elem().Kind() == reflect.Uint8:
+			// A []byte is a single unindexed property.
+			fc.noIndex = true
+		case field.Type.Kind() == reflect.Slice &&
+			isPropertyType(field.Type.Elem()):
+			fc.multiple = true
+		case field.Type.Kind() == reflect.Slice &&
+			field.Type.Elem().Kind() == reflect.Slice &&
+			field.Type.Elem().Elem().Kind() == reflect.Uint8:
+			// A [][]byte is a multi-valued unindexed property.
+			fc.multiple = true
+			fc.noIndex = true
+		case isPropertyType(field.Type):
+		default:
+			continue
+		}
+		codec.fields = append(codec.fields, fc)
+		codec.byName[name] = fc
+	}
+	structCodecs[ty] = codec
+	return codec
+}
+
+// copyValue returns a copy of a property value that shares no memory with
+// value. Only []byte values are mutable so the rest are returned as is.
+func copyValue(value interface{}) interface{} {
+	if b, ok := value.([]byte); ok && b != nil {
+		return append([]byte{}, b...)
+	}
+	return value
+}
+
+// normalizeValue returns value as production stores it. Times are truncated
+// to microseconds and returned in UTC.
+func normalizeValue(value interface{}) interface{} {
+	if t, ok := value.(time.Time); ok {
+		return time.Unix(t.Unix(), int64(t.Nanosecond()/1e3*1e3)).UTC()
+	}
+	return value
+}
+
+// baseValue returns the value of v as one of the property value types. Named
+// types such as time.Duration are saved as their underlying type like they
+// are in production.
+func baseValue(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Int64:
+		return v.Int()
+	case reflect.String:
+		return v.String()
+	case reflect.Float64:
+		return v.Float()
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.Slice:
+		if v.IsNil() {
+			return []byte(nil)
+		}
+		return append([]byte{}, v.Bytes()...)
+	}
+	return v.Interface()
+}
+
+// assignValue sets field to v, converting it to named types that have the
+// same underlying kind. It returns false if v cannot be assigned to field.
+func assignValue(field, v reflect.Value) bool {
+	ty := field.Type()
+	switch {
+	case v.Type().AssignableTo(ty):
+		field.Set(v)
+	case v.Kind() == ty.Kind() && v.Type().ConvertibleTo(ty):
+		field.Set(v.Convert(ty))
+	default:
+		return false
+	}
+	return true
+}
+
+// saveStruct returns the properties of the struct val using the same field
+// rules as the ds backend. The properties share no memory with val so later
+// changes to its slices do not change stored entities, and values are
+// normalized like production.
+func saveStruct(val reflect.Value) propertyList {
+	pl := propertyList{}
+	for _, fc := range getStructCodec(val.Type()).fields {
+		fieldVal := val.Field(fc.index)
+
+		if !fc.multiple {
+			pl = append(pl, property{
+				name:    fc.name,
+				value:   normalizeValue(baseValue(fieldVal)),
+				noIndex: fc.noIndex,
+			})
+			continue
+		}
+
+		for j := 0; j < fieldVal.Len(); j++ {
+			pl = append(pl, property{
+				name:     fc.name,
+				value:    normalizeValue(baseValue(fieldVal.Index(j))),
+				noIndex:  fc.noIndex,
+				multiple: true,
+			})
+		}
+	}
+	return pl
+}
+
+// loadStruct sets the fields of the struct val from pl. Fields without a
+// property are left unchanged and fields with a nil property are zeroed.
+// Slice fields with properties are newly allocated so they share no memory
+// with pl. Properties that cannot be loaded are skipped and the first of them
+// is returned as a *datastore.ErrFieldMismatch.
+func loadStruct(pl propertyList, val reflect.Value) error {
+	codec := getStructCodec(val.Type())
+
+	var mismatch error
+	loaded := map[string]bool{}
+	for _, p := range pl {
+		reason := loadProperty(codec, p, val, loaded)
+		if reason != "" && mismatch == nil {
+			mismatch = &datastore.ErrFieldMismatch{
+				StructType: val.Type(),
+				FieldName:  p.name,
+				Reason:     reason,
+			}
+		}
+	}
+	return mismatch
+}
+
+// loadProperty sets the field of val for p. It returns why p could not be
+// loaded or "" if it was. loaded holds the slice fields that have already
+// been reset.
+func loadProperty(codec *structCodec, p property, val reflect.Value,
+	loaded map[string]bool) string {
+
+	fc, exists := codec.byName[p.name]
+	if !exists {
+		return "no such struct field"
+	}
+	field := val.Field(fc.index)
+
+	if fc.multiple {
+		if !loaded[p.name] {
+			field.Set(reflect.Zero(field.Type()))
+			loaded[p.name] = true
+		}
+		elem := reflect.New(field.Type().Elem()).Elem()
+		if p.value != nil &&
+			!assignValue(elem, reflect.ValueOf(copyValue(p.value))) {
+			return typeMismatch(p.value, elem.Type())
+		}
+		field.Set(reflect.Append(field, elem))
+		return ""
+	} else if p.multiple {
+		return "multiple-valued property requires a slice field type"
+	}
+
+	if p.value == nil {
+		field.Set(reflect.Zero(field.Type()))
+		return ""
+	}
+	if !assignValue(field, reflect.ValueOf(copyValue(p.value))) {
+		return typeMismatch(p.value, field.Type())
+	}
+	return ""
+}
+
+func typeMismatch(value interface{}, ty reflect.Type) string {
+	return fmt.Sprintf("type mismatch: %T versus %v", value, ty)
+}
+
+// property returns the value of the named property from pl and whether it
+// is unindexed. Entities are treated as property sets so a property only
+// exists if it has a value, which may be nil, and multiple values are
+// returned as a []interface{}.
+func (pl propertyList) property(name string) (interface{}, bool, bool) {
+	var values []interface{}
+	noIndex := false
+	for _, p := range pl {
+		if p.name != name {
+			continue
+		}
+		if !p.multiple {
+			return p.value, p.noIndex, true
+		}
+		values = append(values, p.value)
+		noIndex = noIndex || p.noIndex
+	}
+	return values, noIndex, values != nil
+}
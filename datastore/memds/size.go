@@ -0,0 +1,151 @@
+package memds
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/qedus/appengine/datastore"
+)
+
+const (
+	// maxEntitySize is the largest entity in bytes that production will store.
+	maxEntitySize = 1048572
+
+	// maxIndexedSize is the longest indexed string or short blob in bytes.
+	maxIndexedSize = 1500
+
+	// maxIndexEntries is the maximum number of index entries per entity.
+	maxIndexEntries = 20000
+)
+
+// The sizes below follow the App Engine storage size calculations except that
+// the application ID is not included in key sizes.
+
+func stringSize(s string) int {
+	return len(s) + 1
+}
+
+func keySize(key datastore.Key) int {
+	size := 16
+	if ns := key.Namespace(); ns != "" {
+		size += stringSize(ns)
+	}
+	for ; key != nil; key = key.Parent() {
+		size += stringSize(key.Kind())
+		switch id := key.ID().(type) {
+		case string:
+			size += stringSize(id)
+		default:
+			size += 8
+		}
+	}
+	return size
+}
+
+func valueSize(value interface{}) int {
+	switch v := value.(type) {
+	case nil, bool:
+		return 1
+	case int64, float64, time.Time:
+		return 8
+	case datastore.GeoPoint:
+		return 16
+	case string:
+		return stringSize(v)
+	case []byte:
+		return len(v) + 1
+	case datastore.Key:
+		return keySize(v)
+	}
+	return 0
+}
+
+// entitySize returns the stored size of an entity in bytes.
+func entitySize(key datastore.Key, pl propertyList) int {
+	size := keySize(key) + 32
+
+	// The name of a multi-valued property is only counted once.
+	names := map[string]bool{}
+	for _, p := range pl {
+		if !names[p.name] {
+			names[p.name] = true
+			size += stringSize(p.name)
+		}
+		size += valueSize(p.value)
+	}
+	return size
+}
+
+// indexEntries returns the number of index entries an entity needs for the
+// built in single property indexes and the declared composite indexes.
+func (ds *Datastore) indexEntries(key datastore.Key, pl propertyList) (
+	builtin, composite int) {
+
+	values := map[string]int{}
+	for _, p := range pl {
+		if p.noIndex {
+			continue
+		}
+
+		// An ascending and descending built in index entry.
+		builtin += 2
+		values[p.name]++
+	}
+
+	ancestors := 0
+	for k := key; k != nil; k = k.Parent() {
+		ancestors++
+	}
+
+	for _, idx := range ds.indexes {
+		if idx.Kind != key.Kind() {
+			continue
+		}
+
+		// Multi-valued properties explode composite indexes.
+		count := 1
+		for _, p := range idx.Properties {
+			count *= values[p.Name]
+		}
+		if idx.Ancestor {
+			count *= ancestors
+		}
+		composite += count
+	}
+	return builtin, composite
+}
+
+// validateEntity returns the same errors as production for entities that are
+// too big to be stored.
+func (ds *Datastore) validateEntity(key datastore.Key,
+	pl propertyList) error {
+
+	for _, p := range pl {
+		if p.noIndex {
+			continue
+		}
+
+		var size int
+		switch v := p.value.(type) {
+		case string:
+			size = len(v)
+		case []byte:
+			size = len(v)
+		}
+		if size > maxIndexedSize {
+			return fmt.Errorf("memds: the value of property %s is longer "+
+				"than %d bytes", p.name, maxIndexedSize)
+		}
+	}
+
+	if entitySize(key, pl) > maxEntitySize {
+		return errors.New("memds: entity is too big")
+	}
+
+	if builtin, composite := ds.indexEntries(key, pl); builtin+composite >
+		maxIndexEntries {
+		return errors.New("memds: too many indexed properties for entity")
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package memds_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/qedus/appengine/datastore"
+	"github.com/qedus/appengine/datastore/memds"
+)
+
+func TestIndexedStringSize(t *testing.T) {
+	ds := memds.New()
+
+	type testEntity struct {
+		Indexed   string
+		Unindexed string `datastore:",noindex"`
+	}
+	key := datastore.NewKey("").IntID("Test", 1)
+
+	if _, err := ds.Put([]datastore.Key{key}, []testEntity{{
+		Indexed:   strings.Repeat("a", 1500),
+		Unindexed: strings.Repeat("a", 100000),
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ds.Put([]datastore.Key{key}, []testEntity{{
+		Indexed: strings.Repeat("a", 1501),
+	}}); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestEntitySize(t *testing.T) {
+	ds := memds.New()
+
+	type testEntity struct {
+		Data []byte
+	}
+	key := datastore.NewKey("").IntID("Test", 1)
+
+	if _, err := ds.Put([]datastore.Key{key}, []testEntity{{
+		Data: make([]byte, 1000000),
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ds.Put([]datastore.Key{key}, []testEntity{{
+		Data: make([]byte, 1<<20),
+	}}); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	// Oversized entities should also fail within transactions.
+	if err := ds.RunInTransaction(func(txDs datastore.Datastore) error {
+		_, err := txDs.Put([]datastore.Key{key}, []testEntity{{
+			Data: make([]byte, 1<<20),
+		}})
+		return err
+	}); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestIndexEntries(t *testing.T) {
+
+	type testEntity struct {
+		A []int64
+		B []int64
+	}
+	key := datastore.NewKey("").IntID("Test", 1)
+
+	values := make([]int64, 200)
+	for i := range values {
+		values[i] = int64(i)
+	}
+
+	// Built in indexes only need 800 entries.
+	ds := memds.New()
+	if _, err := ds.Put([]datastore.Key{key}, []testEntity{{
+		A: values,
+		B: values,
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A composite index on both properties explodes to 40000 entries.
+	ds = memds.NewWithOptions(memds.Options{
+		Indexes: []memds.Index{{
+			Kind: "Test",
+			Properties: []memds.IndexProperty{
+				{Name: "A"},
+				{Name: "B"},
+			},
+		}},
+	})
+	if _, err := ds.Put([]datastore.Key{key}, []testEntity{{
+		A: values,
+		B: values,
+	}}); err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,435 @@
+package memds
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+	"unicode/utf8"
+
+	"github.com/qedus/appengine/datastore"
+)
+
+// snapshotVersion is the version of the snapshot format written by Save.
+//
+// A snapshot is a single JSON object:
+//
+//	{
+//		"version": 2,
+//		"sequences": [
+//			{"kind": "Parent", "last": 3},
+//			{
+//				"namespace": "ns",
+//				"parent": {
+//					"namespace": "ns",
+//					"path": [{"kind": "Parent", "stringID": "a"}]
+//				},
+//				"kind": "Child",
+//				"last": 12
+//			}
+//		],
+//		"entities": [
+//			{
+//				"key": {
+//					"namespace": "ns",
+//					"path": [
+//						{"kind": "Parent", "stringID": "a"},
+//						{"kind": "Child", "intID": 12}
+//					]
+//				},
+//				"properties": [
+//					{"name": "Count", "type": "int", "value": 3},
+//					{"name": "Tags", "type": "string", "value": "a",
+//						"multiple": true},
+//					{"name": "Data", "type": "bytes", "value": "aGk=",
+//						"noIndex": true}
+//				]
+//			}
+//		]
+//	}
+//
+// sequences are the last IDs allocated for each kind and parent. An optional
+// "draws" is the number of values the scattered IDs have taken from their
+// source of randomness so a restored datastore does not repeat them. Property
+// types are null, int, float, bool, string, rawstring (a string that is not
+// valid UTF-8 as base64), bytes (base64), time (RFC 3339 with nanoseconds),
+// geopoint (an object with lat and lng) and key (an object like the entity
+// key). Each element of a multi-valued property is a separate property with
+// multiple set.
+//
+// Version 1 snapshots, which have a single "lastIntID" in place of sequences,
+// can still be loaded. See restore.
+const snapshotVersion = 2
+
+type snapshot struct {
+	Version   int                `json:"version"`
+	LastIntID int64              `json:"lastIntID,omitempty"`
+	Sequences []snapshotSequence `json:"sequences"`
+	Draws     int64              `json:"draws,omitempty"`
+	Entities  []snapshotEntity   `json:"entities"`
+}
+
+type snapshotSequence struct {
+	Namespace string       `json:"namespace,omitempty"`
+	Parent    *snapshotKey `json:"parent,omitempty"`
+	Kind      string       `json:"kind"`
+	Last      int64        `json:"last"`
+}
+
+type snapshotEntity struct {
+	Key        *snapshotKey       `json:"key"`
+	Properties []snapshotProperty `json:"properties"`
+}
+
+type snapshotKey struct {
+	Namespace string                `json:"namespace,omitempty"`
+	Path      []snapshotPathElement `json:"path"`
+}
+
+type snapshotPathElement struct {
+	Kind     string `json:"kind"`
+	IntID    int64  `json:"intID,omitempty"`
+	StringID string `json:"stringID,omitempty"`
+}
+
+type snapshotGeoPoint struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+type snapshotProperty struct {
+	Name     string          `json:"name"`
+	Type     string          `json:"type"`
+	Value    json.RawMessage `json:"value,omitempty"`
+	NoIndex  bool            `json:"noIndex,omitempty"`
+	Multiple bool            `json:"multiple,omitempty"`
+}
+
+func encodeKey(key datastore.Key) *snapshotKey {
+	namespace := key.Namespace()
+	path := []snapshotPathElement{}
+	for ; key != nil; key = key.Parent() {
+		elem := snapshotPathElement{
+			Kind: key.Kind(),
+		}
+		switch id := key.ID().(type) {
+		case int64:
+			elem.IntID = id
+		case string:
+			elem.StringID = id
+		}
+		path = append([]snapshotPathElement{elem}, path...)
+	}
+	return &snapshotKey{
+		Namespace: namespace,
+		Path:      path,
+	}
+}
+
+func decodeKey(sk *snapshotKey) (datastore.Key, error) {
+	if sk == nil || len(sk.Path) == 0 {
+		return nil, errors.New("memds: snapshot key has no path")
+	}
+
+	key := datastore.NewKey(sk.Namespace)
+	for _, elem := range sk.Path {
+		switch {
+		case elem.Kind == "":
+			return nil, errors.New("memds: snapshot key has no kind")
+		case elem.StringID != "" && elem.IntID != 0:
+			return nil, errors.New("memds: snapshot key has two IDs")
+		case elem.StringID != "":
+			key = key.StringID(elem.Kind, elem.StringID)
+		case elem.IntID != 0:
+			key = key.IntID(elem.Kind, elem.IntID)
+		default:
+			return nil, errors.New("memds: snapshot key is incomplete")
+		}
+	}
+	return key, nil
+}
+
+func encodeProperty(p property) (snapshotProperty, error) {
+	sp := snapshotProperty{
+		Name:     p.name,
+		NoIndex:  p.noIndex,
+		Multiple: p.multiple,
+	}
+
+	var value interface{}
+	switch v := p.value.(type) {
+	case nil:
+		sp.Type = "null"
+		return sp, nil
+	case int64:
+		sp.Type = "int"
+		value = v
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return sp, fmt.Errorf("memds: cannot save float %v", v)
+		}
+		sp.Type = "float"
+		value = v
+	case bool:
+		sp.Type = "bool"
+		value = v
+	case string:
+		// JSON strings must be UTF-8 so other strings are saved as bytes to
+		// keep them intact.
+		sp.Type = "string"
+		value = v
+		if !utf8.ValidString(v) {
+			sp.Type = "rawstring"
+			value = []byte(v)
+		}
+	case []byte:
+		sp.Type = "bytes"
+		value = v
+	case time.Time:
+		sp.Type = "time"
+		value = v.Format(time.RFC3339Nano)
+	case datastore.GeoPoint:
+		sp.Type = "geopoint"
+		value = snapshotGeoPoint{v.Lat, v.Lng}
+	case datastore.Key:
+		sp.Type = "key"
+		value = encodeKey(v)
+	default:
+		return sp, fmt.Errorf("memds: cannot save property type %T", v)
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return sp, err
+	}
+	sp.Value = data
+	return sp, nil
+}
+
+func decodeProperty(sp snapshotProperty) (property, error) {
+	p := property{
+		name:     sp.Name,
+		noIndex:  sp.NoIndex,
+		multiple: sp.Multiple,
+	}
+
+	var err error
+	switch sp.Type {
+	case "null":
+		return p, nil
+	case "int":
+		var v int64
+		err = json.Unmarshal(sp.Value, &v)
+		p.value = v
+	case "float":
+		var v float64
+		err = json.Unmarshal(sp.Value, &v)
+		p.value = v
+	case "bool":
+		var v bool
+		err = json.Unmarshal(sp.Value, &v)
+		p.value = v
+	case "string":
+		var v string
+		err = json.Unmarshal(sp.Value, &v)
+		p.value = v
+	case "bytes":
+		var v []byte
+		err = json.Unmarshal(sp.Value, &v)
+		p.value = v
+	case "rawstring":
+		var v []byte
+		err = json.Unmarshal(sp.Value, &v)
+		p.value = string(v)
+	case "time":
+		var s string
+		if err = json.Unmarshal(sp.Value, &s); err == nil {
+			var t time.Time
+			t, err = time.Parse(time.RFC3339Nano, s)
+			p.value = normalizeValue(t)
+		}
+	case "geopoint":
+		var v snapshotGeoPoint
+		err = json.Unmarshal(sp.Value, &v)
+		p.value = datastore.GeoPoint{Lat: v.Lat, Lng: v.Lng}
+	case "key":
+		sk := &snapshotKey{}
+		if err = json.Unmarshal(sp.Value, sk); err == nil {
+			p.value, err = decodeKey(sk)
+		}
+	default:
+		return p, fmt.Errorf("memds: unknown snapshot property type %s",
+			sp.Type)
+	}
+	if err != nil {
+		return p, fmt.Errorf("memds: invalid %s property %s: %v",
+			sp.Type, sp.Name, err)
+	}
+	return p, nil
+}
+
+func encodeSequence(seq *sequence) snapshotSequence {
+	ss := snapshotSequence{
+		Namespace: seq.namespace,
+		Kind:      seq.kind,
+		Last:      seq.last,
+	}
+	if seq.parent != nil {
+		ss.Parent = encodeKey(seq.parent)
+	}
+	return ss
+}
+
+func decodeSequence(ss snapshotSequence) (*sequence, error) {
+	seq := &sequence{
+		namespace: ss.Namespace,
+		kind:      ss.Kind,
+		last:      ss.Last,
+	}
+	if ss.Parent != nil {
+		parent, err := decodeKey(ss.Parent)
+		if err != nil {
+			return nil, err
+		}
+		seq.parent = parent
+	}
+	return seq, nil
+}
+
+func encodeProperties(pl propertyList) ([]snapshotProperty, error) {
+	sps := make([]snapshotProperty, len(pl))
+	for i, p := range pl {
+		sp, err := encodeProperty(p)
+		if err != nil {
+			return nil, err
+		}
+		sps[i] = sp
+	}
+	return sps, nil
+}
+
+func decodeProperties(sps []snapshotProperty) (propertyList, error) {
+	pl := make(propertyList, len(sps))
+	for i, sp := range sps {
+		p, err := decodeProperty(sp)
+		if err != nil {
+			return nil, err
+		}
+		pl[i] = p
+	}
+	return pl, nil
+}
+
+// snapshot returns a snapshot of entities and the state of the ID allocator.
+func (ds *Datastore) snapshot(entities []keyEntity) (snapshot, error) {
+	s := snapshot{
+		Version:   snapshotVersion,
+		Sequences: make([]snapshotSequence, len(ds.allocator.sequences)),
+		Draws:     ds.allocator.draws(),
+		Entities:  make([]snapshotEntity, len(entities)),
+	}
+	for i, seq := range ds.allocator.sequences {
+		s.Sequences[i] = encodeSequence(seq)
+	}
+	for i, ke := range entities {
+		sps, err := encodeProperties(ke.entity)
+		if err != nil {
+			return snapshot{}, err
+		}
+		s.Entities[i] = snapshotEntity{
+			Key:        encodeKey(ke.key),
+			Properties: sps,
+		}
+	}
+	return s, nil
+}
+
+func writeSnapshot(w io.Writer, s snapshot) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(s)
+}
+
+// Save writes every entity and the state of the ID allocator to w as a
+// versioned JSON snapshot that can be restored with Load. Entities are saved
+// as property values rather than Go struct values so a snapshot can be loaded
+// into different struct types. Any pending writes are applied first.
+func (ds *Datastore) Save(w io.Writer) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	ds.applyJobs(func(*job) bool {
+		return true
+	})
+	s, err := ds.snapshot(ds.store.all())
+	if err != nil {
+		return err
+	}
+	return writeSnapshot(w, s)
+}
+
+// restore replaces the contents of the datastore with s.
+//
+// Version 1 snapshots allocated IDs from a single counter, lastIntID, shared
+// by every kind. It is migrated by starting the sequence of every kind and
+// parent in the snapshot's keys after it so no stored ID is handed out again.
+func (ds *Datastore) restore(s snapshot) error {
+	if s.Version != 1 && s.Version != snapshotVersion {
+		return fmt.Errorf("memds: unsupported snapshot version %d", s.Version)
+	}
+
+	migrated := &allocator{}
+	for _, ss := range s.Sequences {
+		seq, err := decodeSequence(ss)
+		if err != nil {
+			return err
+		}
+		migrated.add(seq)
+	}
+
+	st := newStore(nil)
+	for _, se := range s.Entities {
+		key, err := decodeKey(se.Key)
+		if err != nil {
+			return err
+		}
+		pl, err := decodeProperties(se.Properties)
+		if err != nil {
+			return err
+		}
+		st.put(key, pl)
+
+		if s.Version == 1 {
+			for k := key; k != nil; k = k.Parent() {
+				migrated.sequence(k).last = s.LastIntID
+			}
+		}
+	}
+
+	ds.store = st
+	ds.allocator.sequences = migrated.sequences
+	ds.allocator.byKey = migrated.byKey
+	ds.allocator.dirty = nil
+	ds.allocator.counter.skipTo(s.Draws)
+	ds.pendingJobs = nil
+	return nil
+}
+
+// Load replaces the contents of the datastore with a snapshot previously
+// written by Save. A datastore created with Open is compacted so the file
+// holds the loaded snapshot.
+func (ds *Datastore) Load(r io.Reader) error {
+	s := snapshot{}
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return err
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if err := ds.restore(s); err != nil {
+		return err
+	}
+	return ds.compact()
+}
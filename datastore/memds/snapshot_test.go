@@ -0,0 +1,268 @@
+package memds_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/qedus/appengine/datastore"
+	"github.com/qedus/appengine/datastore/memds"
+)
+
+func TestSaveLoad(t *testing.T) {
+
+	type testEntity struct {
+		Int    int64
+		Float  float64
+		Bool   bool
+		String string `datastore:"str"`
+		Bytes  []byte
+		Time   time.Time
+		Key    datastore.Key
+		Ints   []int64
+		Ignore int64 `datastore:"-"`
+	}
+
+	ds := memds.New()
+
+	keys := []datastore.Key{
+		datastore.NewKey("").StringID("Test", "a"),
+		datastore.NewKey("ns").IntID("Parent", 3).IncompleteID("Test"),
+	}
+	putEntities := []testEntity{
+		{
+			Int:    1,
+			Float:  2.5,
+			Bool:   true,
+			String: "three",
+			Bytes:  []byte{4},
+			Time:   time.Unix(5, 6000).UTC(),
+			Key:    datastore.NewKey("ns").StringID("Other", "seven"),
+			Ints:   []int64{8, 9},
+		},
+		{
+			Int:    10,
+			Ignore: 11,
+		},
+	}
+	keys, err := ds.Put(keys, putEntities)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := ds.Save(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	loadDs := memds.New()
+	if err := loadDs.Load(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	getEntities := make([]testEntity, len(keys))
+	if err := loadDs.Get(keys, getEntities); err != nil {
+		t.Fatal(err)
+	}
+
+	putEntities[1].Ignore = 0
+	if !reflect.DeepEqual(putEntities[0], getEntities[0]) {
+		t.Fatalf("entities not equal %+v vs %+v",
+			putEntities[0], getEntities[0])
+	}
+	if !reflect.DeepEqual(putEntities[1], getEntities[1]) {
+		t.Fatalf("entities not equal %+v vs %+v",
+			putEntities[1], getEntities[1])
+	}
+
+	// Snapshots store properties so can be loaded into a different struct.
+	// Properties the struct lacks are reported but the rest are loaded.
+	type narrowEntity struct {
+		String string `datastore:"str"`
+		Ints   []int64
+	}
+	narrow := &narrowEntity{}
+	err = loadDs.Get(keys[:1], []*narrowEntity{narrow})
+	if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+		t.Fatal("expected field mismatch error got", err)
+	}
+	if narrow.String != "three" || !reflect.DeepEqual(narrow.Ints,
+		[]int64{8, 9}) {
+		t.Fatal("incorrect entity", narrow)
+	}
+
+	// Queries should work on loaded entities.
+	iter, err := loadDs.Run(datastore.Query{
+		Kind: "Test",
+		Filters: []datastore.Filter{
+			{"Ints", datastore.EqualOp, int64(9)},
+		},
+		KeysOnly: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, err := iter.Next(nil); err != nil {
+		t.Fatal(err)
+	} else if !keys[0].Equal(key) {
+		t.Fatal("incorrect key", key)
+	}
+
+	// The ID allocator should continue where it left off.
+	newKeys, err := loadDs.AllocateKeys(keys[1], 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newKeys[0].Equal(keys[1]) {
+		t.Fatal("allocated key clashes with loaded key")
+	}
+}
+
+func TestLoadVersion(t *testing.T) {
+	ds := memds.New()
+	if err := ds.Load(bytes.NewBufferString(
+		`{"version": 1000}`)); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestLoadVersion1(t *testing.T) {
+	ds := memds.New()
+	if err := ds.Load(bytes.NewBufferString(`{
+		"version": 1,
+		"lastIntID": 12,
+		"entities": [{
+			"key": {
+				"namespace": "ns",
+				"path": [
+					{"kind": "Parent", "stringID": "a"},
+					{"kind": "Child", "intID": 12}
+				]
+			},
+			"properties": [{"name": "Count", "type": "int", "value": 3}]
+		}]
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	type testEntity struct {
+		Count int64
+	}
+	parent := datastore.NewKey("ns").StringID("Parent", "a")
+	entities := make([]testEntity, 1)
+	if err := ds.Get([]datastore.Key{parent.IntID("Child", 12)},
+		entities); err != nil {
+		t.Fatal(err)
+	}
+	if entities[0].Count != 3 {
+		t.Fatal("expected count 3 got", entities[0].Count)
+	}
+
+	// The old shared lastIntID carries on in the sequences of the loaded
+	// keys.
+	for _, key := range []datastore.Key{
+		parent.IncompleteID("Child"),
+		datastore.NewKey("ns").IncompleteID("Parent"),
+	} {
+		allocated, err := ds.AllocateKeys(key, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id := allocated[0].ID(); id != int64(13) {
+			t.Fatal("expected ID 13 got", id)
+		}
+	}
+}
+
+func TestSaveLoadNamedTypes(t *testing.T) {
+	type status string
+	type blob []byte
+	type testEntity struct {
+		Status  status
+		Timeout time.Duration
+		Data    blob
+		Tags    []status
+	}
+
+	ds := memds.New()
+	key := datastore.NewKey("").StringID("Test", "a")
+	put := testEntity{
+		Status:  "active",
+		Timeout: time.Second,
+		Data:    blob{1, 2},
+		Tags:    []status{"a", "b"},
+	}
+	if _, err := ds.Put([]datastore.Key{key},
+		[]testEntity{put}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := ds.Save(buf); err != nil {
+		t.Fatal(err)
+	}
+	loadDs := memds.New()
+	if err := loadDs.Load(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]testEntity, 1)
+	if err := loadDs.Get([]datastore.Key{key}, got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(put, got[0]) {
+		t.Fatalf("entities not equal %+v vs %+v", put, got[0])
+	}
+
+	// Named types are stored as their underlying type so can be queried with
+	// plain values.
+	iter, err := loadDs.Run(datastore.Query{
+		Kind: "Test",
+		Filters: []datastore.Filter{
+			{"Timeout", datastore.EqualOp, int64(time.Second)},
+		},
+		KeysOnly: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k, err := iter.Next(nil); err != nil {
+		t.Fatal(err)
+	} else if !key.Equal(k) {
+		t.Fatal("incorrect key", k)
+	}
+}
+
+func TestSaveLoadInvalidUTF8(t *testing.T) {
+	type testEntity struct {
+		Valid   string
+		Invalid string
+		Strings []string
+	}
+
+	ds := memds.New()
+	key := datastore.NewKey("").IntID("Test", 1)
+	put := testEntity{"héllo", "\xff\xfe", []string{"a", "b\x80c"}}
+	if _, err := ds.Put([]datastore.Key{key},
+		[]testEntity{put}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := ds.Save(buf); err != nil {
+		t.Fatal(err)
+	}
+	loadDs := memds.New()
+	if err := loadDs.Load(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]testEntity, 1)
+	if err := loadDs.Get([]datastore.Key{key}, got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(put, got[0]) {
+		t.Fatalf("entities not equal %q vs %q", put, got[0])
+	}
+}
@@ -0,0 +1,153 @@
+package memds
+
+import (
+	"strings"
+	"time"
+
+	"github.com/qedus/appengine/datastore"
+)
+
+const (
+	// statKindKind is the kind of the per kind statistics entities. Each has
+	// the kind name as its string ID.
+	statKindKind = "__Stat_Kind__"
+
+	// statTotalKind is the kind of the statistics entity for the whole
+	// datastore.
+	statTotalKind = "__Stat_Total__"
+	statTotalName = "total_entity_usage"
+)
+
+// usage is the storage used by a set of entities.
+type usage struct {
+	count               int64
+	entityBytes         int64
+	builtinIndexBytes   int64
+	builtinIndexCount   int64
+	compositeIndexBytes int64
+	compositeIndexCount int64
+}
+
+func (u *usage) add(o usage) {
+	u.count += o.count
+	u.entityBytes += o.entityBytes
+	u.builtinIndexBytes += o.builtinIndexBytes
+	u.builtinIndexCount += o.builtinIndexCount
+	u.compositeIndexBytes += o.compositeIndexBytes
+	u.compositeIndexCount += o.compositeIndexCount
+}
+
+// properties returns the production statistics properties for u.
+func (u usage) properties(timestamp time.Time) propertyList {
+	return propertyList{
+		{name: "count", value: u.count},
+		{name: "bytes", value: u.entityBytes + u.builtinIndexBytes +
+			u.compositeIndexBytes},
+		{name: "timestamp", value: normalizeValue(timestamp)},
+		{name: "entity_bytes", value: u.entityBytes},
+		{name: "builtin_index_bytes", value: u.builtinIndexBytes},
+		{name: "builtin_index_count", value: u.builtinIndexCount},
+		{name: "composite_index_bytes", value: u.compositeIndexBytes},
+		{name: "composite_index_count", value: u.compositeIndexCount},
+	}
+}
+
+// entityUsage returns the storage used by a single entity. Index entry sizes
+// are estimates made from the key, kind, property name and value sizes.
+func (ds *Datastore) entityUsage(ke keyEntity) usage {
+	builtin, composite := ds.indexEntries(ke.key, ke.entity)
+	entryKeySize := int64(keySize(ke.key) + stringSize(ke.key.Kind()))
+
+	u := usage{
+		count:               1,
+		entityBytes:         int64(entitySize(ke.key, ke.entity)),
+		builtinIndexCount:   int64(builtin),
+		compositeIndexCount: int64(composite),
+		compositeIndexBytes: int64(composite) * entryKeySize,
+	}
+	for _, p := range ke.entity {
+		if p.noIndex {
+			continue
+		}
+
+		// An ascending and descending entry for each value.
+		u.builtinIndexBytes += 2 * (entryKeySize +
+			int64(stringSize(p.name)+valueSize(p.value)))
+	}
+	return u
+}
+
+// isStatKind returns true for the kinds production does not include in
+// statistics, such as the statistics themselves.
+func isStatKind(kind string) bool {
+	return strings.HasPrefix(kind, "__")
+}
+
+// RecomputeStats replaces the __Stat_Kind__ and __Stat_Total__ entities in the
+// default namespace with statistics for the entities currently stored, using
+// the same properties as production. Like production the statistics are not
+// updated as entities change, so RecomputeStats must be called again to
+// refresh them. Byte counts are estimates of the production storage sizes.
+// Pending writes that have not been applied are not included.
+//
+// The statistics are committed like any other write so they are persisted,
+// recorded as changes and subject to the consistency policy. An error is
+// returned if they cannot be persisted.
+func (ds *Datastore) RecomputeStats() error {
+	ds.mu.Lock()
+	defer ds.unlock()
+
+	kinds := map[string]*usage{}
+	kindNames := []string{}
+	total := usage{}
+
+	for _, ke := range ds.store.all() {
+		kind := ke.key.Kind()
+		if isStatKind(kind) {
+			continue
+		}
+
+		u := ds.entityUsage(ke)
+		if kinds[kind] == nil {
+			kinds[kind] = &usage{}
+			kindNames = append(kindNames, kind)
+		}
+		kinds[kind].add(u)
+		total.add(u)
+	}
+
+	timestamp := ds.clock.Now()
+	mutations := []mutation{}
+	for _, kind := range kindNames {
+		pl := propertyList{{name: "kind_name", value: kind}}
+		mutations = append(mutations, mutation{
+			key:    datastore.NewKey("").StringID(statKindKind, kind),
+			entity: append(pl, kinds[kind].properties(timestamp)...),
+		})
+	}
+	mutations = append(mutations, mutation{
+		key:    datastore.NewKey("").StringID(statTotalKind, statTotalName),
+		entity: total.properties(timestamp),
+	})
+
+	// Remove the old statistics of kinds that no longer exist, including
+	// any that are still pending.
+	for _, ke := range ds.committed() {
+		if ke.key.Namespace() != "" || (ke.key.Kind() != statKindKind &&
+			ke.key.Kind() != statTotalKind) {
+			continue
+		}
+
+		replaced := false
+		for _, m := range mutations {
+			replaced = replaced || m.key.Equal(ke.key)
+		}
+		if !replaced {
+			mutations = append(mutations, mutation{
+				key: ke.key,
+			})
+		}
+	}
+
+	return ds.write(mutations, 0)
+}
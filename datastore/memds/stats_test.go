@@ -0,0 +1,133 @@
+package memds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qedus/appengine/datastore"
+	"github.com/qedus/appengine/datastore/memds"
+)
+
+// ignoreMismatch returns err unless it is a *datastore.ErrFieldMismatch,
+// which is expected when loading entities into structs with only some of their
+// properties.
+func ignoreMismatch(err error) error {
+	if _, ok := err.(*datastore.ErrFieldMismatch); ok {
+		return nil
+	}
+	return err
+}
+
+func TestRecomputeStats(t *testing.T) {
+	ds := memds.New()
+
+	type testEntity struct {
+		Value string
+	}
+
+	keys := []datastore.Key{
+		datastore.NewKey("").StringID("A", "1"),
+		datastore.NewKey("").StringID("A", "2"),
+		datastore.NewKey("ns").StringID("B", "3"),
+	}
+	if _, err := ds.Put(keys, make([]testEntity, len(keys))); err != nil {
+		t.Fatal(err)
+	}
+
+	type kindStat struct {
+		KindName          string    `datastore:"kind_name"`
+		Count             int64     `datastore:"count"`
+		Bytes             int64     `datastore:"bytes"`
+		Timestamp         time.Time `datastore:"timestamp"`
+		EntityBytes       int64     `datastore:"entity_bytes"`
+		BuiltinIndexCount int64     `datastore:"builtin_index_count"`
+	}
+
+	// Statistics only exist once they have been computed.
+	stat := &kindStat{}
+	statKey := datastore.NewKey("").StringID("__Stat_Kind__", "A")
+	if err := ds.Get([]datastore.Key{statKey},
+		[]*kindStat{stat}); err == nil {
+		t.Fatal("expected not found error")
+	}
+
+	if err := ds.RecomputeStats(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ignoreMismatch(ds.Get([]datastore.Key{statKey},
+		[]*kindStat{stat})); err != nil {
+		t.Fatal(err)
+	}
+	if stat.KindName != "A" || stat.Count != 2 ||
+		stat.BuiltinIndexCount != 4 || stat.EntityBytes == 0 ||
+		stat.Bytes <= stat.EntityBytes || stat.Timestamp.IsZero() {
+		t.Fatalf("incorrect kind stat %+v", stat)
+	}
+
+	total := &kindStat{}
+	if err := ignoreMismatch(ds.Get([]datastore.Key{
+		datastore.NewKey("").StringID("__Stat_Total__",
+			"total_entity_usage"),
+	}, []*kindStat{total})); err != nil {
+		t.Fatal(err)
+	}
+	if total.Count != 3 {
+		t.Fatalf("incorrect total stat %+v", total)
+	}
+
+	// Recomputing does not count the statistics entities themselves.
+	if err := ds.RecomputeStats(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ignoreMismatch(ds.Get([]datastore.Key{
+		datastore.NewKey("").StringID("__Stat_Total__",
+			"total_entity_usage"),
+	}, []*kindStat{total})); err != nil {
+		t.Fatal(err)
+	}
+	if total.Count != 3 {
+		t.Fatalf("incorrect recomputed total stat %+v", total)
+	}
+
+	// Statistics of kinds that no longer have entities are removed.
+	if err := ds.Delete(keys[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.RecomputeStats(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.Get([]datastore.Key{statKey},
+		[]*kindStat{stat}); err == nil {
+		t.Fatal("expected not found error")
+	}
+}
+
+func TestRecomputeStatsDurable(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	ds := open(t, path)
+	key := datastore.NewKey("").IntID("Test", 1)
+	if _, err := ds.Put([]datastore.Key{key},
+		[]durableEntity{{1, nil}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.RecomputeStats(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Statistics are written like any other entity so they are recovered.
+	type totalStat struct {
+		Count int64 `datastore:"count"`
+	}
+	stats := make([]totalStat, 1)
+	if err := ignoreMismatch(open(t, path).Get([]datastore.Key{
+		datastore.NewKey("").StringID("__Stat_Total__",
+			"total_entity_usage"),
+	}, stats)); err != nil {
+		t.Fatal(err)
+	}
+	if stats[0].Count != 1 {
+		t.Fatal("expected count 1 got", stats[0].Count)
+	}
+}
@@ -0,0 +1,260 @@
+package memds
+
+import (
+	"sort"
+
+	"github.com/qedus/appengine/datastore"
+)
+
+// keyString returns a string that uniquely identifies key so it can be used
+// as a map key. The strings of two keys compare in the same order as
+// compareKeys orders the keys, so entities can be kept in key order without
+// comparing their keys.
+func keyString(key datastore.Key) string {
+	b := appendOrdered(nil, key.Namespace())
+	for _, elem := range keyPath(key) {
+		b = appendOrdered(b, elem.Kind())
+		switch id := elem.ID().(type) {
+		case int64:
+			// Integer IDs come before string IDs and the sign bit is flipped
+			// so negative IDs come before positive ones.
+			u := uint64(id) ^ 1<<63
+			b = append(b, 1, byte(u>>56), byte(u>>48), byte(u>>40),
+				byte(u>>32), byte(u>>24), byte(u>>16), byte(u>>8), byte(u))
+		case string:
+			b = appendOrdered(append(b, 2), id)
+		default:
+			// Incomplete keys are only used to identify ID sequences.
+			b = append(b, 0)
+		}
+	}
+	return string(b)
+}
+
+// appendOrdered appends s to b so that appended strings compare in the same
+// order as the strings themselves whatever follows them. Zero bytes are
+// escaped and the string is terminated by a zero byte.
+func appendOrdered(b []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		b = append(b, s[i])
+		if s[i] == 0 {
+			b = append(b, 0xff)
+		}
+	}
+	return append(b, 0, 1)
+}
+
+// store holds the applied entities. A store can be layered on top of a
+// parent store in order to share the parent's entities without copying them.
+// The parent must not change once it has children.
+type store struct {
+	parent *store
+
+	// entities are the entities written to this layer and deleted are the
+	// keys deleted from it, hiding any parent entity.
+	entities map[string]keyEntity
+	deleted  map[string]bool
+
+	// sorted caches every entity in key order and sortedKeys their
+	// keyStrings in the same order. Once the caches are filled, writes keep
+	// them up to date rather than discarding them.
+	sorted     []keyEntity
+	sortedKeys []string
+}
+
+func newStore(parent *store) *store {
+	return &store{
+		parent:   parent,
+		entities: map[string]keyEntity{},
+		deleted:  map[string]bool{},
+	}
+}
+
+func (s *store) get(key datastore.Key) (keyEntity, bool) {
+	ks := keyString(key)
+	for ; s != nil; s = s.parent {
+		if ke, exists := s.entities[ks]; exists {
+			return ke, true
+		}
+		if s.deleted[ks] {
+			return keyEntity{}, false
+		}
+	}
+	return keyEntity{}, false
+}
+
+func (s *store) put(key datastore.Key, entity propertyList) {
+	ks := keyString(key)
+	ke := keyEntity{
+		key:    key,
+		entity: entity,
+	}
+	s.entities[ks] = ke
+	delete(s.deleted, ks)
+
+	if s.sorted == nil {
+		return
+	}
+	i := sort.SearchStrings(s.sortedKeys, ks)
+	if i < len(s.sortedKeys) && s.sortedKeys[i] == ks {
+		s.sorted[i] = ke
+		return
+	}
+	s.sorted = append(s.sorted, keyEntity{})
+	copy(s.sorted[i+1:], s.sorted[i:])
+	s.sorted[i] = ke
+	s.sortedKeys = append(s.sortedKeys, "")
+	copy(s.sortedKeys[i+1:], s.sortedKeys[i:])
+	s.sortedKeys[i] = ks
+}
+
+func (s *store) del(key datastore.Key) {
+	ks := keyString(key)
+	delete(s.entities, ks)
+	if s.parent != nil {
+		s.deleted[ks] = true
+	}
+
+	if s.sorted == nil {
+		return
+	}
+	i := sort.SearchStrings(s.sortedKeys, ks)
+	if i < len(s.sortedKeys) && s.sortedKeys[i] == ks {
+		s.sorted = append(s.sorted[:i], s.sorted[i+1:]...)
+		s.sortedKeys = append(s.sortedKeys[:i], s.sortedKeys[i+1:]...)
+	}
+}
+
+// all returns every entity in key order. The returned slice must not be
+// modified and is only valid until the next write.
+func (s *store) all() []keyEntity {
+	sorted, _ := s.sortedEntities()
+	return sorted
+}
+
+// sortedEntities returns every entity in key order along with their
+// keyStrings.
+func (s *store) sortedEntities() ([]keyEntity, []string) {
+	if s.sorted != nil {
+		return s.sorted, s.sortedKeys
+	} else if s.parent != nil && len(s.entities) == 0 && len(s.deleted) == 0 {
+		return s.parent.sortedEntities()
+	}
+
+	localKeys := make([]string, 0, len(s.entities))
+	for ks := range s.entities {
+		localKeys = append(localKeys, ks)
+	}
+	sort.Strings(localKeys)
+	deletedKeys := make([]string, 0, len(s.deleted))
+	for ks := range s.deleted {
+		deletedKeys = append(deletedKeys, ks)
+	}
+	sort.Strings(deletedKeys)
+
+	var inherited []keyEntity
+	var inheritedKeys []string
+	if s.parent != nil {
+		inherited, inheritedKeys = s.parent.sortedEntities()
+	}
+
+	// Merge the parent's entities that have not been replaced or deleted with
+	// the entities in this layer. Every list is in key order so they are
+	// merged in a single pass.
+	size := len(inherited) + len(localKeys)
+	sorted := make([]keyEntity, 0, size)
+	sortedKeys := make([]string, 0, size)
+	i, d := 0, 0
+	for j, ks := range inheritedKeys {
+		for ; i < len(localKeys) && localKeys[i] < ks; i++ {
+			sorted = append(sorted, s.entities[localKeys[i]])
+			sortedKeys = append(sortedKeys, localKeys[i])
+		}
+		for d < len(deletedKeys) && deletedKeys[d] < ks {
+			d++
+		}
+		replaced := i < len(localKeys) && localKeys[i] == ks
+		deleted := d < len(deletedKeys) && deletedKeys[d] == ks
+		if !replaced && !deleted {
+			sorted = append(sorted, inherited[j])
+			sortedKeys = append(sortedKeys, ks)
+		}
+	}
+	for ; i < len(localKeys); i++ {
+		sorted = append(sorted, s.entities[localKeys[i]])
+		sortedKeys = append(sortedKeys, localKeys[i])
+	}
+
+	s.sorted, s.sortedKeys = sorted, sortedKeys
+	return sorted, sortedKeys
+}
+
+// Fork returns an independent copy of the datastore. Writes to either
+// datastore are not seen by the other. The entities are shared copy-on-write
+// so forking is cheap even for large datastores, which allows an expensive
+// dataset to be created once and then forked for each test. The fork records
+// the indexes its queries need in the same log as ds. A fork of a durable
+// datastore is only held in memory.
+//
+// Forks can be made and used from different goroutines, for example in
+// parallel tests. Each fork
+// gets its own copy of a policy from RandomConsistencyPolicy. Other
+// consistency policies and the Clock are shared so must be safe for
+// concurrent use.
+func (ds *Datastore) Fork() *Datastore {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	// Freeze the current layer and put both datastores on top of it. If
+	// nothing has been written since the last fork the frozen layer below
+	// can be shared instead.
+	base := ds.store
+	if base.parent != nil && len(base.entities) == 0 &&
+		len(base.deleted) == 0 {
+		base = base.parent
+	} else {
+		ds.store = newStore(base)
+	}
+
+	// Fill the sorted caches of the frozen layers now, while they are only
+	// reachable by this goroutine, so forks only ever read them.
+	base.all()
+
+	return &Datastore{
+		store:     newStore(base),
+		allocator: ds.allocator.fork(),
+
+		clock:              ds.clock,
+		transactionTimeout: ds.transactionTimeout,
+
+		// The change log is shared until either datastore records a
+		// change, which copies it because it has no spare capacity.
+		recordChanges: ds.recordChanges,
+		changes:       ds.changes[:len(ds.changes):len(ds.changes)],
+		transactions:  ds.transactions,
+
+		consistencyPolicy: forkPolicy(ds.consistencyPolicy),
+		pendingJobs:       append([]*job{}, ds.pendingJobs...),
+
+		indexes:         ds.indexes,
+		requiredIndexes: ds.requiredIndexes,
+	}
+}
+
+// Reset deletes every entity, pending write and recorded change and resets
+// the ID allocator so the datastore is the same as a newly created one. The
+// options the datastore was created with, its subscribers and the indexes its
+// queries needed are kept. The file of a durable datastore is emptied too and
+// any error doing so is returned, as well as by later writes.
+func (ds *Datastore) Reset() error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	ds.store = newStore(nil)
+	ds.allocator = ds.allocator.reset()
+	ds.pendingJobs = nil
+	ds.changes = nil
+	ds.transactions = 0
+	ds.unnotified = nil
+	return ds.compact()
+}
@@ -0,0 +1,282 @@
+package memds_test
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/qedus/appengine/datastore"
+	"github.com/qedus/appengine/datastore/memds"
+)
+
+func TestFork(t *testing.T) {
+	base := memds.New()
+
+	type testEntity struct {
+		Value int64
+	}
+
+	keys := make([]datastore.Key, 10)
+	for i := range keys {
+		keys[i] = datastore.NewKey("").StringID("Test", strconv.Itoa(i))
+	}
+	if _, err := base.Put(keys, make([]testEntity, len(keys))); err != nil {
+		t.Fatal(err)
+	}
+
+	fork := base.Fork()
+	if err := fork.Delete(keys[:5]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fork.Put(keys[5:6], []testEntity{{5}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes to the base after forking are not seen by the fork.
+	extraKey := datastore.NewKey("").StringID("Test", "extra")
+	if _, err := base.Put([]datastore.Key{extraKey},
+		[]testEntity{{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if base.Len() != 11 {
+		t.Fatal("expected 11 base entities got", base.Len())
+	}
+	if fork.Len() != 5 {
+		t.Fatal("expected 5 fork entities got", fork.Len())
+	}
+	if fork.Has(extraKey) {
+		t.Fatal("fork has entity put after forking")
+	}
+
+	entity := &testEntity{}
+	if err := base.Get(keys[5:6], []*testEntity{entity}); err != nil {
+		t.Fatal(err)
+	}
+	if entity.Value != 0 {
+		t.Fatal("base entity changed by fork")
+	}
+	if count := countQuery(t, fork, datastore.Query{
+		Kind: "Test",
+		Filters: []datastore.Filter{
+			{"Value", datastore.EqualOp, int64(5)},
+		},
+	}); count != 1 {
+		t.Fatal("expected 1 fork query result got", count)
+	}
+
+	// Forks of forks are also independent.
+	forkFork := fork.Fork()
+	if err := forkFork.Delete(keys[5:]); err != nil {
+		t.Fatal(err)
+	}
+	if forkFork.Len() != 0 || fork.Len() != 5 || base.Len() != 11 {
+		t.Fatal("incorrect entity counts", forkFork.Len(), fork.Len(),
+			base.Len())
+	}
+
+	// Both datastores continue to allocate IDs from the same point.
+	key := datastore.NewKey("").IncompleteID("Test")
+	baseKeys, err := base.AllocateKeys(key, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forkKeys, err := fork.AllocateKeys(key, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !baseKeys[0].Equal(forkKeys[0]) {
+		t.Fatal("expected the same allocated keys", baseKeys, forkKeys)
+	}
+}
+
+func TestForkKeyOrder(t *testing.T) {
+	type testEntity struct{}
+
+	// Keys in production's order: by namespace and then one path element at
+	// a time by kind and ID, with integer IDs before string IDs and keys
+	// before their descendants.
+	root := datastore.NewKey("")
+	ordered := []datastore.Key{
+		root.IntID("A", 1),
+		root.IntID("A", 1).IntID("B", 1),
+		root.IntID("A", 1).StringID("B", "a"),
+		root.IntID("A", 2),
+		root.IntID("A", 10),
+		root.IntID("A", 1<<40),
+		root.StringID("A", "a"),
+		root.StringID("A", "a\x00"),
+		root.StringID("A", "a\x00b"),
+		root.StringID("A", "a\x01"),
+		root.StringID("A", "b"),
+		root.IntID("A\x00", 1),
+		root.IntID("AB", 1),
+		root.IntID("B", 1),
+		datastore.NewKey("a").IntID("A", 1),
+	}
+	checkOrder := func(ds *memds.Datastore, expected []datastore.Key) {
+		t.Helper()
+		dump := ds.Dump()
+		if len(dump) != len(expected) {
+			t.Fatalf("expected %d entities got %d", len(expected), len(dump))
+		}
+		for i, e := range dump {
+			if !e.Key.Equal(expected[i]) {
+				t.Fatal(i, "expected key", expected[i], "got", e.Key)
+			}
+		}
+	}
+
+	// Write every other key to the base and the rest to a fork one at a time,
+	// reading the entities in between so they are kept in order as they are
+	// written.
+	base := memds.New()
+	var baseKeys []datastore.Key
+	for i := 1; i < len(ordered); i += 2 {
+		baseKeys = append(baseKeys, ordered[i])
+	}
+	for i := len(baseKeys) - 1; i >= 0; i-- {
+		if _, err := base.Put(baseKeys[i:i+1],
+			[]testEntity{{}}); err != nil {
+			t.Fatal(err)
+		}
+		checkOrder(base, baseKeys[i:])
+	}
+
+	fork := base.Fork()
+	for i := 0; i < len(ordered); i += 2 {
+		if _, err := fork.Put(ordered[i:i+1], []testEntity{{}}); err != nil {
+			t.Fatal(err)
+		}
+		fork.Len()
+	}
+	checkOrder(fork, ordered)
+	checkOrder(base, baseKeys)
+
+	// Deleting and replacing keys inherited from the base keeps the order.
+	if err := fork.Delete(ordered[1:2]); err != nil {
+		t.Fatal(err)
+	}
+	checkOrder(fork, append(ordered[:1:1], ordered[2:]...))
+	if _, err := fork.Put(ordered[1:4],
+		make([]testEntity, 3)); err != nil {
+		t.Fatal(err)
+	}
+	checkOrder(fork, ordered)
+
+	// Queries without orders return entities in key order.
+	iter, err := fork.Run(datastore.Query{
+		KeysOnly: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(ordered)-1; i++ {
+		key, err := iter.Next(nil)
+		if err != nil {
+			t.Fatal(err)
+		} else if key == nil || !key.Equal(ordered[i]) {
+			t.Fatal(i, "expected key", ordered[i], "got", key)
+		}
+	}
+}
+
+func TestForkParallel(t *testing.T) {
+	base := memds.NewWithOptions(memds.Options{
+		ConsistencyPolicy: memds.RandomConsistencyPolicy(0.5, 1),
+	})
+
+	type testEntity struct {
+		Value int64
+		Group int64
+	}
+
+	keys := make([]datastore.Key, 100)
+	entities := make([]testEntity, len(keys))
+	for i := range keys {
+		keys[i] = datastore.NewKey("").IntID("Test", int64(i+1))
+		entities[i] = testEntity{int64(i), int64(i % 10)}
+	}
+	if _, err := base.Put(keys, entities); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each fork is made, written to and queried in its own goroutine. Run
+	// with -race to check the forks share nothing that is written.
+	useFork := func(i int) error {
+		fork := base.Fork()
+		if _, err := fork.Put(keys[i:i+1],
+			[]testEntity{{-1, int64(i)}}); err != nil {
+			return err
+		}
+		fork.ApplyPending()
+
+		// Needs a composite index so the shared index log is written to.
+		iter, err := fork.Run(datastore.Query{
+			Kind: "Test",
+			Filters: []datastore.Filter{
+				{"Group", datastore.EqualOp, int64(i)},
+				{"Value", datastore.LessThanOp, int64(0)},
+			},
+			KeysOnly: true,
+		})
+		if err != nil {
+			return err
+		}
+		key, err := iter.Next(nil)
+		if err != nil {
+			return err
+		} else if key == nil || !key.Equal(keys[i]) {
+			return fmt.Errorf("expected %v got %v", keys[i], key)
+		}
+
+		if fork.Len() != len(keys) {
+			return fmt.Errorf("expected %d entities got %d", len(keys),
+				fork.Len())
+		}
+		return nil
+	}
+
+	errs := make(chan error)
+	for i := 0; i < 8; i++ {
+		go func(i int) {
+			errs <- useFork(i)
+		}(i)
+	}
+	for i := 0; i < 8; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if indexes := base.RequiredIndexes(); len(indexes) != 1 {
+		t.Fatal("expected 1 required index got", indexes)
+	}
+}
+
+func TestReset(t *testing.T) {
+	ds := memds.New()
+
+	type testEntity struct{}
+	key := datastore.NewKey("").IncompleteID("Test")
+	keys, err := ds.Put([]datastore.Key{key}, []testEntity{{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ds.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if ds.Len() != 0 {
+		t.Fatal("expected no entities got", ds.Len())
+	}
+
+	// The ID allocator starts again.
+	resetKeys, err := ds.Put([]datastore.Key{key}, []testEntity{{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resetKeys[0].Equal(keys[0]) {
+		t.Fatal("expected", keys[0], "got", resetKeys[0])
+	}
+}
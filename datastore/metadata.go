@@ -0,0 +1,100 @@
+package datastore
+
+import (
+	"errors"
+)
+
+const (
+	// NamespaceKind is the metadata kind of the namespaces in the datastore.
+	// The default namespace has the integer ID 1 and all others use the
+	// namespace name as their string ID.
+	NamespaceKind = "__namespace__"
+
+	// KindKind is the metadata kind of the kinds within a namespace. The kind
+	// name is the string ID.
+	KindKind = "__kind__"
+
+	// PropertyKind is the metadata kind of the indexed properties of a kind.
+	// Each key has the property name as its string ID and a KindKind parent.
+	PropertyKind = "__property__"
+)
+
+// keyNames runs the keys only query q and returns the ID of each key.
+func keyNames(ds Datastore, q Query) ([]string, error) {
+	q.KeysOnly = true
+	iter, err := ds.Run(q)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for {
+		key, err := iter.Next(nil)
+		if err != nil {
+			return nil, err
+		} else if key == nil {
+			return names, nil
+		}
+
+		switch id := key.ID().(type) {
+		case string:
+			names = append(names, id)
+		case int64:
+			// Only the default namespace has an integer ID.
+			names = append(names, "")
+		default:
+			return nil, errors.New("metadata key has no ID")
+		}
+	}
+}
+
+// Namespaces returns the names of all the namespaces that contain entities.
+// The default namespace is returned as an empty string.
+func Namespaces(ds Datastore) ([]string, error) {
+	return keyNames(ds, Query{
+		Kind: NamespaceKind,
+	})
+}
+
+// Kinds returns the names of all the kinds in namespace.
+func Kinds(ds Datastore, namespace string) ([]string, error) {
+	return keyNames(ds, Query{
+		Namespace: namespace,
+		Kind:      KindKind,
+	})
+}
+
+// Properties returns the indexed properties of kind within namespace. The map
+// is keyed by property name with the representations used by its values, such
+// as INT64 or STRING, as values.
+func Properties(ds Datastore, namespace, kind string) (map[string][]string,
+	error) {
+
+	iter, err := ds.Run(Query{
+		Namespace: namespace,
+		Kind:      PropertyKind,
+		Ancestor:  NewKey(namespace).StringID(KindKind, kind),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	properties := map[string][]string{}
+	for {
+		entity := &struct {
+			Representation []string `datastore:"property_representation"`
+		}{}
+		key, err := iter.Next(entity)
+		if err != nil {
+			return nil, err
+		} else if key == nil {
+			return properties, nil
+		}
+
+		name, ok := key.ID().(string)
+		if !ok {
+			return nil, errors.New("metadata key has no name")
+		}
+		properties[name] = entity.Representation
+	}
+}
@@ -2,6 +2,7 @@ package datastore
 
 import (
 	"errors"
+	"fmt"
 	"reflect"
 	"strings"
 	"time"
@@ -141,6 +142,8 @@ func (ds *datastore) valueToPropertyList(value reflect.Value) (
 			switch v := value.Field(i).Interface().(type) {
 			case time.Time:
 				propValue = v
+			case eds.GeoPoint:
+				propValue = appengine.GeoPoint{Lat: v.Lat, Lng: v.Lng}
 			default:
 				continue
 			}
@@ -158,22 +161,7 @@ func (ds *datastore) valueToPropertyList(value reflect.Value) (
 			}
 			propValue = aeKey
 		case reflect.Slice:
-			// Only accept certain types of slice.
-			switch structField.Type.Elem().Kind() {
-			case reflect.Int64, reflect.Float64, reflect.String:
-
-				// Must convert the slice to a slice of properties.
-				slice := value.Field(i)
-				for i := 0; i < slice.Len(); i++ {
-					pl = append(pl, aeds.Property{
-						Name:     propName,
-						Value:    slice.Index(i).Interface(),
-						NoIndex:  PropertyNoIndex(structField),
-						Multiple: true,
-					})
-				}
-				continue
-			case reflect.Uint8: // byte
+			if structField.Type.Elem().Kind() == reflect.Uint8 {
 				// Treat []byte as a standard property, not a multi property.
 				propValue = value.Field(i).Interface()
 
@@ -185,10 +173,28 @@ func (ds *datastore) valueToPropertyList(value reflect.Value) (
 					Multiple: false,
 				})
 				continue
+			}
 
-			default:
-				continue
+			// Must convert the slice to a slice of properties. Slices of
+			// []byte are unindexed like []byte.
+			noIndex := PropertyNoIndex(structField) ||
+				structField.Type.Elem().Kind() == reflect.Slice
+			slice := value.Field(i)
+			for j := 0; j < slice.Len(); j++ {
+				elemValue, ok, err := ds.elemValue(slice.Index(j))
+				if err != nil {
+					return nil, err
+				} else if !ok {
+					continue
+				}
+				pl = append(pl, aeds.Property{
+					Name:     propName,
+					Value:    elemValue,
+					NoIndex:  noIndex,
+					Multiple: true,
+				})
 			}
+			continue
 
 		default:
 			continue
@@ -205,8 +211,72 @@ func (ds *datastore) valueToPropertyList(value reflect.Value) (
 	return pl, nil
 }
 
+// elemValue returns the property value of a slice element and false if the
+// element type cannot be saved.
+func (ds *datastore) elemValue(elem reflect.Value) (interface{}, bool, error) {
+	switch elem.Kind() {
+	case reflect.Int64, reflect.Float64, reflect.String, reflect.Bool:
+		return elem.Interface(), true, nil
+	case reflect.Slice:
+		if elem.Type().Elem().Kind() == reflect.Uint8 {
+			return elem.Interface(), true, nil
+		}
+	case reflect.Struct:
+		switch v := elem.Interface().(type) {
+		case time.Time:
+			return v, true, nil
+		case eds.GeoPoint:
+			return appengine.GeoPoint{Lat: v.Lat, Lng: v.Lng}, true, nil
+		}
+	case reflect.Interface:
+		key, ok := elem.Interface().(eds.Key)
+		if !ok {
+			return nil, false, nil
+		}
+		aeKey, err := ds.toAEKey(key)
+		if err != nil {
+			return nil, false, err
+		}
+		return aeKey, true, nil
+	}
+	return nil, false, nil
+}
+
+// fromAEValue returns an App Engine property value as the value of a field.
+func fromAEValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case *aeds.Key:
+		return toKey(v)
+	case appengine.GeoPoint:
+		return eds.GeoPoint{Lat: v.Lat, Lng: v.Lng}
+	}
+	return value
+}
+
+// assignValue sets field to v if v is assignable or, for named types such as
+// a string-based type, convertible to it. It returns false if it is neither.
+func assignValue(field, v reflect.Value) bool {
+	ty := field.Type()
+	switch {
+	case v.Type().AssignableTo(ty):
+		field.Set(v)
+	case v.Kind() == ty.Kind() && v.Type().ConvertibleTo(ty):
+		field.Set(v.Convert(ty))
+	default:
+		return false
+	}
+	return true
+}
+
+func typeMismatch(value interface{}, ty reflect.Type) string {
+	return fmt.Sprintf("type mismatch: %T versus %v", value, ty)
+}
+
+// propertyListToValue loads pl into the struct value. Properties that cannot
+// be loaded are skipped and the first of them is returned as an
+// *eds.ErrFieldMismatch, like the official package does.
 func (ds *datastore) propertyListToValue(pl aeds.PropertyList,
-	value reflect.Value) {
+	value reflect.Value) error {
 	if value.Kind() == reflect.Interface {
 		value = value.Elem()
 	}
@@ -229,23 +299,46 @@ func (ds *datastore) propertyListToValue(pl aeds.PropertyList,
 		fieldValues[propName] = value.Field(i)
 	}
 
+	var mismatch error
+	setMismatch := func(name, reason string) {
+		if mismatch == nil {
+			mismatch = &eds.ErrFieldMismatch{
+				StructType: valueType,
+				FieldName:  name,
+				Reason:     reason,
+			}
+		}
+	}
+
 	multiProps := map[string]reflect.Value{}
 	for _, p := range pl {
 
 		// Is there a struct field that can take this property?
 		v, exists := fieldValues[p.Name]
 		if !exists {
+			setMismatch(p.Name, "no such struct field")
 			continue
 		}
 
 		if p.Multiple {
+			if v.Kind() != reflect.Slice {
+				setMismatch(p.Name,
+					"multiple-valued property requires a slice field type")
+				continue
+			}
 			if _, exists := multiProps[p.Name]; !exists {
-				sliceType := reflect.SliceOf(reflect.TypeOf(p.Value))
-				multiProps[p.Name] = reflect.MakeSlice(sliceType, 0, 1)
+				multiProps[p.Name] = reflect.MakeSlice(v.Type(), 0, 1)
 			}
 
-			multiProps[p.Name] = reflect.Append(multiProps[p.Name],
-				reflect.ValueOf(p.Value))
+			// Use the field's element type so keys can be appended to a
+			// []Key.
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if propValue := fromAEValue(p.Value); propValue != nil &&
+				!assignValue(elem, reflect.ValueOf(propValue)) {
+				setMismatch(p.Name, typeMismatch(propValue, elem.Type()))
+				continue
+			}
+			multiProps[p.Name] = reflect.Append(multiProps[p.Name], elem)
 			continue
 		}
 
@@ -254,14 +347,10 @@ func (ds *datastore) propertyListToValue(pl aeds.PropertyList,
 		}
 
 		// Do any of the property values need to be transformed.
-		propValue := p.Value
-
-		switch v := propValue.(type) {
-		case *aeds.Key:
-			propValue = toKey(v)
+		propValue := fromAEValue(p.Value)
+		if !assignValue(v, reflect.ValueOf(propValue)) {
+			setMismatch(p.Name, typeMismatch(propValue, v.Type()))
 		}
-
-		v.Set(reflect.ValueOf(propValue))
 	}
 
 	for propName, propValues := range multiProps {
@@ -272,6 +361,7 @@ func (ds *datastore) propertyListToValue(pl aeds.PropertyList,
 
 		fieldValue.Set(propValues)
 	}
+	return mismatch
 }
 
 func (ds *datastore) Get(keys []eds.Key, entities interface{}) error {
@@ -287,19 +377,27 @@ func (ds *datastore) Get(keys []eds.Key, entities interface{}) error {
 	pls := make([]aeds.PropertyList, len(keys))
 	switch err := ds.get(ds.ctx, aeKeys, pls).(type) {
 	case nil:
+		var mismatch error
 		values := reflect.ValueOf(entities)
 		for i, pl := range pls {
-			ds.propertyListToValue(pl, values.Index(i))
+			err := ds.propertyListToValue(pl, values.Index(i))
+			if mismatch == nil {
+				mismatch = err
+			}
 		}
-		return nil
+		return mismatch
 	case appengine.MultiError:
 		nfe := notFoundError{}
 
+		var mismatch error
 		values := reflect.ValueOf(entities)
 		for i, pl := range pls {
 			switch err[i] {
 			case nil:
-				ds.propertyListToValue(pl, values.Index(i))
+				err := ds.propertyListToValue(pl, values.Index(i))
+				if mismatch == nil {
+					mismatch = err
+				}
 			case aeds.ErrNoSuchEntity:
 				nfe[i] = true
 			default:
@@ -307,6 +405,9 @@ func (ds *datastore) Get(keys []eds.Key, entities interface{}) error {
 			}
 		}
 
+		if len(nfe) == 0 {
+			return mismatch
+		}
 		return nfe
 	default:
 		return err
@@ -429,6 +530,19 @@ func (ds *datastore) AllocateKeys(key eds.Key, n int) ([]eds.Key, error) {
 	return keys, nil
 }
 
+func (ds *datastore) AllocateKeyRange(key eds.Key, start, end int64) error {
+	ctx, err := appengine.Namespace(ds.ctx, key.Namespace())
+	if err != nil {
+		return err
+	}
+	parentKey, err := ds.toAEKey(key.Parent())
+	if err != nil {
+		return err
+	}
+
+	return aeds.AllocateIDRange(ctx, key.Kind(), parentKey, start, end)
+}
+
 type iterator struct {
 	ds   *datastore
 	iter *aeds.Iterator
@@ -447,7 +561,8 @@ func (it *iterator) Next(entity interface{}) (eds.Key, error) {
 	// Entity could be nil if keys only queries are used.
 	if entity != nil {
 		// Currently used to convert datastore.Keys to this packages keys.
-		it.ds.propertyListToValue(pl, reflect.ValueOf(entity))
+		return toKey(aeKey), it.ds.propertyListToValue(pl,
+			reflect.ValueOf(entity))
 	}
 
 	return toKey(aeKey), nil
@@ -478,9 +593,12 @@ func PropertyName(field reflect.StructField) string {
 
 func PropertyNoIndex(field reflect.StructField) bool {
 
+	// Any of the tag options after the name can be noindex.
 	tagValues := strings.Split(field.Tag.Get("datastore"), ",")
-	if len(tagValues) > 1 {
-		return tagValues[1] == "noindex"
+	for _, option := range tagValues[1:] {
+		if option == "noindex" {
+			return true
+		}
 	}
 	return false
 }
@@ -535,12 +653,15 @@ func (ds *datastore) Run(q eds.Query) (eds.Iterator, error) {
 		value := f.Value
 
 		// Convert Key values to datastore.Keys.
-		if key, ok := value.(eds.Key); ok {
-			aeKey, err := ds.toAEKey(key)
+		switch v := value.(type) {
+		case eds.Key:
+			aeKey, err := ds.toAEKey(v)
 			if err != nil {
 				panic(err)
 			}
 			value = aeKey
+		case eds.GeoPoint:
+			value = appengine.GeoPoint{Lat: v.Lat, Lng: v.Lng}
 		}
 
 		aeQ = aeQ.Filter(f.Name+opStr, value)